@@ -3,8 +3,8 @@ package cdnjs
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/donseba/go-importmap/library"
 )
@@ -18,8 +18,12 @@ type (
 	Client struct {
 		apiBaseURL string
 		cdnBaseURL string
+		httpClient *http.Client
 	}
 
+	// Option configures the Client
+	Option func(*Client)
+
 	SearchResponse struct {
 		Name     string   `json:"name"`
 		Latest   string   `json:"latest"`
@@ -33,64 +37,104 @@ type (
 		Version string   `json:"version"`
 		Files   []string `json:"files"`
 	}
+
+	// VersionResponse lists the files of a single version
+	VersionResponse struct {
+		Name    string   `json:"name"`
+		Version string   `json:"version"`
+		Files   []string `json:"files"`
+	}
 )
 
-func New() *Client {
-	return &Client{
+func New(opts ...Option) *Client {
+	c := &Client{
 		apiBaseURL: defaultApiBaseURL,
 		cdnBaseURL: defaultCdnBaseURL,
+		httpClient: http.DefaultClient,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
-func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
-	url := defaultApiBaseURL + name
+// WithHTTPClient sets the http client used for all requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.SetHTTPClient(hc)
+	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, "", err
+// WithAPIBase sets the base URL of the library metadata API, e.g. a mirror of https://api.cdnjs.com/libraries/
+func WithAPIBase(u string) Option {
+	return func(c *Client) {
+		c.apiBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, "", err
+// WithCDNBase sets the base URL the library files are served from, e.g. a mirror of https://cdnjs.cloudflare.com/ajax/libs/
+func WithCDNBase(u string) Option {
+	return func(c *Client) {
+		c.cdnBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("client api responded with code %d", resp.StatusCode)
+// SetHTTPClient sets the http client used for all requests, nil restores http.DefaultClient
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
 	}
+	c.httpClient = hc
+}
 
-	var sr SearchResponse
-	err = json.NewDecoder(resp.Body).Decode(&sr)
+// HTTPClient returns the http client used for all requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Name returns the name of the provider
+func (c *Client) Name() string {
+	return "cdnjs"
+}
+
+func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
+	sr, err := c.search(ctx, name, version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	useVersion, err := library.ResolveVersion(name, version, sr.Versions, map[string]string{"latest": sr.Version})
 	if err != nil {
 		return nil, "", err
 	}
 
-	var (
-		useVersion = sr.Version
-	)
+	basePath := c.cdnBaseURL + name + "/" + useVersion + "/"
 
-	if version != "" && version != useVersion {
-		for _, v := range sr.Versions {
-			if version == v {
-				useVersion = v
-				break
-			}
+	// only use the files of the resolved version, older versions are listed by the version endpoint
+	var names []string
+	for _, assets := range sr.Assets {
+		if assets.Version == useVersion {
+			names = assets.Files
 		}
 	}
 
-	basePath := c.cdnBaseURL + name + "/" + useVersion + "/"
+	if names == nil && useVersion != sr.Version {
+		names, err = c.versionFiles(ctx, name, useVersion)
+		if err != nil {
+			return nil, "", err
+		}
+	}
 
 	var files library.Files
 
-	for _, assets := range sr.Assets {
-		for _, v := range assets.Files {
-			files = append(files, library.File{
-				Type:      library.ExtractFileType(v),
-				Path:      basePath + v,
-				LocalPath: v,
-			})
-		}
+	for _, v := range names {
+		files = append(files, library.File{
+			Type:      library.ExtractFileType(v),
+			Path:      basePath + v,
+			LocalPath: v,
+		})
 	}
 
 	if len(files) == 0 && sr.Filename != "" {
@@ -103,3 +147,62 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 
 	return files, useVersion, nil
 }
+
+// FetchVersions lists the versions of the library
+func (c *Client) FetchVersions(ctx context.Context, name string) ([]string, error) {
+	sr, err := c.search(ctx, name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return sr.Versions, nil
+}
+
+// search retrieves the library metadata, the version is only used in errors
+func (c *Client) search(ctx context.Context, name, version string) (SearchResponse, error) {
+	var sr SearchResponse
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.apiBaseURL+name, nil)
+	if err != nil {
+		return sr, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return sr, err
+	}
+	defer resp.Body.Close()
+
+	if err = library.ResponseError(resp, c.Name(), name, version, library.ErrPackageNotFound); err != nil {
+		return sr, err
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&sr)
+	return sr, err
+}
+
+// versionFiles lists the files of a single version of the library
+func (c *Client) versionFiles(ctx context.Context, name, version string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.apiBaseURL+name+"/"+version, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = library.ResponseError(resp, c.Name(), name, version, library.ErrVersionNotFound); err != nil {
+		return nil, err
+	}
+
+	var vr VersionResponse
+	err = json.NewDecoder(resp.Body).Decode(&vr)
+	if err != nil {
+		return nil, err
+	}
+
+	return vr.Files, nil
+}
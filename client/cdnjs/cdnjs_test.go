@@ -1,8 +1,15 @@
 package cdnjs
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/donseba/go-importmap/library"
 )
 
 func TestClient_Search(t *testing.T) {
@@ -45,3 +52,72 @@ func TestClient_Search(t *testing.T) {
 		})
 	}
 }
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClient_HTTPClient(t *testing.T) {
+	var requested []string
+	hc := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = append(requested, r.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"name":"htmx","version":"2.0.4","versions":["2.0.4"],"filename":"htmx.min.js"}`)),
+		}, nil
+	})}
+
+	files, version, err := New(WithHTTPClient(hc)).FetchPackageFiles(t.Context(), "htmx", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if version != "2.0.4" || len(files) != 1 || files[0].Path != "https://cdnjs.cloudflare.com/ajax/libs/htmx/2.0.4/htmx.min.js" {
+		t.Errorf("unexpected result %s %v", version, files)
+	}
+
+	if len(requested) != 1 || requested[0] != "https://api.cdnjs.com/libraries/htmx" {
+		t.Errorf("unexpected requests %v", requested)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/htmx", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"name":"htmx","version":"2.0.4","versions":["1.9.10","1.9.12","2.0.3","2.0.4"],"filename":"htmx.min.js","assets":[{"version":"2.0.4","files":["htmx.min.js","htmx.js"]}]}`)
+	})
+	mux.HandleFunc("/api/htmx/1.9.12", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"name":"htmx","version":"1.9.12","files":["htmx.min.js"]}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cdn := New(WithAPIBase(srv.URL+"/api"), WithCDNBase(srv.URL+"/cdn"))
+
+	files, version, err := cdn.FetchPackageFiles(t.Context(), "htmx", "^1.9")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if version != "1.9.12" || len(files) != 1 || files[0].Path != srv.URL+"/cdn/htmx/1.9.12/htmx.min.js" {
+		t.Errorf("unexpected result %s %v", version, files)
+	}
+
+	_, _, err = cdn.FetchPackageFiles(t.Context(), "htmx", "2.0.9")
+
+	var notFound *library.VersionNotFoundError
+	if !errors.As(err, &notFound) || !errors.Is(err, library.ErrVersionNotFound) {
+		t.Errorf("expected a VersionNotFoundError, got %v", err)
+		return
+	}
+
+	if notFound.Package != "htmx" || strings.Join(notFound.Nearby, ",") != "1.9.10,1.9.12,2.0.3,2.0.4" {
+		t.Errorf("unexpected error %+v", notFound)
+	}
+}
@@ -2,42 +2,107 @@ package esmsh
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/donseba/go-importmap/library"
 )
 
 var (
-	defaultApiBaseURL = "https://esm.sh/"
+	defaultApiBaseURL      = "https://esm.sh/"
+	defaultCdnBaseURL      = "https://esm.sh/"
+	defaultRegistryBaseURL = "https://registry.npmjs.org/" // npm registry used to resolve versions
 )
 
 // Client holds configuration for esm.sh requests.
 type Client struct {
-	apiBaseURL string
+	apiBaseURL      string
+	cdnBaseURL      string
+	registryBaseURL string
+	httpClient      *http.Client
 }
 
+// Option configures the Client.
+type Option func(*Client)
+
 // New creates a new esm.sh client.
-func New() *Client {
-	return &Client{
-		apiBaseURL: defaultApiBaseURL,
+func New(opts ...Option) *Client {
+	c := &Client{
+		apiBaseURL:      defaultApiBaseURL,
+		cdnBaseURL:      defaultCdnBaseURL,
+		registryBaseURL: defaultRegistryBaseURL,
+		httpClient:      http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// WithHTTPClient sets the http client used for all requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.SetHTTPClient(hc)
+	}
+}
+
+// WithAPIBase sets the base URL used for the meta and package.json requests, e.g. a mirror of https://esm.sh/.
+func WithAPIBase(u string) Option {
+	return func(c *Client) {
+		c.apiBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+}
+
+// WithCDNBase sets the base URL the built modules are served from, e.g. a mirror of https://esm.sh/.
+func WithCDNBase(u string) Option {
+	return func(c *Client) {
+		c.cdnBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
 }
 
+// WithRegistryBase sets the base URL of the npm registry used to resolve versions, e.g. a mirror of https://registry.npmjs.org/.
+func WithRegistryBase(u string) Option {
+	return func(c *Client) {
+		c.registryBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+}
+
+// SetHTTPClient sets the http client used for all requests, nil restores http.DefaultClient.
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c.httpClient = hc
+}
+
+// HTTPClient returns the http client used for all requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Name returns the name of the provider
+func (c *Client) Name() string {
+	return "esmsh"
+}
+
 // FetchPackageFiles retrieves package metadata from esm.sh.
 // It calls the ?meta endpoint, then parses the returned JavaScript snippet to extract the version
 // and the main export file URL. It returns a single file in the library.Files slice.
 func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
-	// If a version is provided, use it; otherwise, let esm.sh resolve the latest version.
-	var pkgID string
-	if version != "" {
-		pkgID = fmt.Sprintf("%s@%s", name, version)
-	} else {
-		pkgID = name
+	// Resolve the version, tag or range against the npm registry so esm.sh builds an exact version.
+	version, err := c.registry().Resolve(ctx, name, version)
+	if err != nil {
+		return nil, "", err
 	}
+	pkgID := fmt.Sprintf("%s@%s", name, version)
 
 	// esm.sh meta endpoint returns a JavaScript snippet
 	metaURL := fmt.Sprintf("%s%s?meta", c.apiBaseURL, pkgID)
@@ -46,14 +111,14 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 		return nil, "", err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("esm.sh meta API responded with code %d", resp.StatusCode)
+	if err = library.ResponseError(resp, c.Name(), name, version, library.ErrPackageNotFound); err != nil {
+		return nil, "", err
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -81,8 +146,8 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 	filePath := matches[1]
 
 	// Construct the full file URL.
-	// esm.sh URLs are absolute, so we prepend the API base URL (ensuring no double slash).
-	fileURL := c.apiBaseURL[:len(c.apiBaseURL)-1] + filePath
+	// esm.sh URLs are absolute, so we prepend the CDN base URL (ensuring no double slash).
+	fileURL := strings.TrimSuffix(c.cdnBaseURL, "/") + filePath
 
 	file := library.File{
 		Type:      library.ExtractFileType(fileURL),
@@ -93,3 +158,72 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 
 	return files, parsedVersion, nil
 }
+
+// FetchDependencies reads the package.json of the package and resolves its dependencies and peer
+// dependencies through the esm.sh meta endpoint
+func (c *Client) FetchDependencies(ctx context.Context, name, version string) ([]library.Dependency, error) {
+	manifestURL := fmt.Sprintf("%s%s@%s/package.json", c.apiBaseURL, name, version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = library.ResponseError(resp, c.Name(), name, version, library.ErrFileNotFound); err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		Dependencies     map[string]string `json:"dependencies"`
+		PeerDependencies map[string]string `json:"peerDependencies"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	ranges := make(map[string]string)
+	for dep, r := range manifest.PeerDependencies {
+		ranges[dep] = r
+	}
+	for dep, r := range manifest.Dependencies {
+		ranges[dep] = r
+	}
+
+	names := make([]string, 0, len(ranges))
+	for dep := range ranges {
+		names = append(names, dep)
+	}
+	sort.Strings(names)
+
+	deps := make([]library.Dependency, 0, len(names))
+	for _, dep := range names {
+		files, depVersion, err := c.FetchPackageFiles(ctx, dep, ranges[dep])
+		if err != nil {
+			return nil, err
+		}
+
+		deps = append(deps, library.Dependency{
+			Name:    dep,
+			Version: depVersion,
+			Entry:   files[0].LocalPath,
+		})
+	}
+
+	return deps, nil
+}
+
+// FetchVersions lists the versions of the package in the npm registry.
+func (c *Client) FetchVersions(ctx context.Context, name string) ([]string, error) {
+	versions, _, err := c.registry().Versions(ctx, name, "")
+	return versions, err
+}
+
+// registry returns the npm registry the versions are resolved against.
+func (c *Client) registry() library.Registry {
+	return library.Registry{BaseURL: c.registryBaseURL, Client: c.httpClient, Provider: c.Name()}
+}
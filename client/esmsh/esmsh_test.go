@@ -2,7 +2,14 @@ package esmsh
 
 import (
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/donseba/go-importmap/library"
 )
 
 func TestNew(t *testing.T) {
@@ -30,3 +37,42 @@ func TestNew(t *testing.T) {
 
 	t.Log(string(out))
 }
+
+func TestFetchDependencies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/registry/core":
+			_, _ = io.WriteString(w, `{"dist-tags":{"latest":"2.1.0"},"versions":{"1.0.0":{},"2.0.0":{},"2.1.0":{}}}`)
+		case r.URL.Path == "/app@1.0.0/package.json":
+			_, _ = io.WriteString(w, `{"dependencies":{"core":"^2.0.0"}}`)
+		case r.URL.Path == "/core@2.1.0" && r.URL.RawQuery == "meta":
+			_, _ = io.WriteString(w, "/* esm.sh - core@2.1.0 */\nexport * from \"/core@2.1.0/es2022/core.mjs\";\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cdn := New(WithAPIBase(srv.URL), WithCDNBase(srv.URL), WithRegistryBase(srv.URL+"/registry"))
+
+	deps, err := cdn.FetchDependencies(t.Context(), "app", "1.0.0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := []library.Dependency{{Name: "core", Version: "2.1.0", Entry: "/core@2.1.0/es2022/core.mjs"}}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("got %+v, want %+v", deps, want)
+	}
+
+	files, _, err := cdn.FetchPackageFiles(t.Context(), "core", "2.1.0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(files) != 1 || files[0].Type != library.FileTypeJS || !strings.HasSuffix(files[0].Path, ".mjs") {
+		t.Errorf("expected the .mjs entry as a js file, got %+v", files)
+	}
+}
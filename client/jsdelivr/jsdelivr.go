@@ -5,32 +5,39 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/donseba/go-importmap/library"
 )
 
 var (
-	defaultApiBaseURL = "https://data.jsdelivr.com/v1/package/npm/"
-	defaultCdnBaseURL = "https://cdn.jsdelivr.net/npm/"
+	defaultApiBaseURL     = "https://data.jsdelivr.com/v1/package/npm/"
+	defaultResolveBaseURL = "https://data.jsdelivr.com/v1/package/resolve/npm/"
+	defaultCdnBaseURL     = "https://cdn.jsdelivr.net/npm/"
 )
 
 type (
 	Client struct {
-		apiBaseURL string
-		cdnBaseURL string
-		esm        bool
+		apiBaseURL     string
+		resolveBaseURL string
+		cdnBaseURL     string
+		esm            bool
+		httpClient     *http.Client
 	}
 
+	// Option configures the Client
+	Option func(*Client)
+
 	SearchResponse struct {
 		Tags     Tags     `json:"tags"`
 		Versions []string `json:"versions"`
 	}
 
-	Tags struct {
-		Latest string `json:"latest"`
-		Next   string `json:"next"`
-	}
+	// Tags maps dist-tags like latest and next to a version
+	Tags map[string]string
 
 	PackageResponse struct {
 		Type    string `json:"type"`
@@ -53,85 +60,127 @@ type (
 	}
 
 	Files []File
+
+	// Manifest holds the dependency fields of a package.json
+	Manifest struct {
+		Type             string            `json:"type"`
+		Main             string            `json:"main"`
+		Module           string            `json:"module"`
+		Exports          json.RawMessage   `json:"exports"`
+		Dependencies     map[string]string `json:"dependencies"`
+		PeerDependencies map[string]string `json:"peerDependencies"`
+	}
+
+	ResolveResponse struct {
+		Version string `json:"version"`
+	}
 )
 
-func New() *Client {
-	return &Client{
-		apiBaseURL: defaultApiBaseURL,
-		cdnBaseURL: defaultCdnBaseURL,
-		esm:        false,
+func New(opts ...Option) *Client {
+	c := &Client{
+		apiBaseURL:     defaultApiBaseURL,
+		resolveBaseURL: defaultResolveBaseURL,
+		cdnBaseURL:     defaultCdnBaseURL,
+		esm:            false,
+		httpClient:     http.DefaultClient,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 // NewESM returns a new Client with ESM mode enabled
-func NewESM() *Client {
-	return &Client{
-		apiBaseURL: defaultApiBaseURL,
-		cdnBaseURL: defaultCdnBaseURL,
-		esm:        true,
+func NewESM(opts ...Option) *Client {
+	return New(opts...).SetESM(true)
+}
+
+// WithHTTPClient sets the http client used for all requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.SetHTTPClient(hc)
 	}
 }
 
-// SetESM sets whether the client should use ESM mode
-func (c *Client) SetESM(useESM bool) *Client {
-	c.esm = useESM
-	return c
+// WithAPIBase sets the base URL of the package metadata API, e.g. a mirror of https://data.jsdelivr.com/v1/package/npm/
+func WithAPIBase(u string) Option {
+	return func(c *Client) {
+		c.apiBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
 }
 
-// FetchPackageFiles retrieves package files from jsdelivr
-func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
-	url := defaultApiBaseURL + name
+// WithResolveBase sets the base URL of the version resolve API, e.g. a mirror of https://data.jsdelivr.com/v1/package/resolve/npm/
+func WithResolveBase(u string) Option {
+	return func(c *Client) {
+		c.resolveBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, "", err
+// WithCDNBase sets the base URL the package files are served from, e.g. a mirror of https://cdn.jsdelivr.net/npm/
+func WithCDNBase(u string) Option {
+	return func(c *Client) {
+		c.cdnBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, "", err
+// SetHTTPClient sets the http client used for all requests, nil restores http.DefaultClient
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
 	}
-	defer resp.Body.Close()
+	c.httpClient = hc
+}
+
+// HTTPClient returns the http client used for all requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// SetESM sets whether the client should use ESM mode
+func (c *Client) SetESM(useESM bool) *Client {
+	c.esm = useESM
+	return c
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("client api responded with code %d", resp.StatusCode)
+// Name returns the name of the provider
+func (c *Client) Name() string {
+	if c.esm {
+		return "jsdelivr-esm"
 	}
+	return "jsdelivr"
+}
 
+// FetchPackageFiles retrieves package files from jsdelivr
+func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
 	var sr SearchResponse
-	err = json.NewDecoder(resp.Body).Decode(&sr)
+	err := c.getJSON(ctx, name, version, c.apiBaseURL+name, library.ErrPackageNotFound, &sr)
 	if err != nil {
 		return nil, "", err
 	}
 
-	var (
-		useVersion = sr.Tags.Latest
-	)
-
-	if version != "" && version != useVersion {
-		for _, v := range sr.Versions {
-			if version == v {
-				useVersion = v
-				break
-			}
-		}
+	useVersion, err := library.ResolveVersion(name, version, sr.Versions, sr.Tags)
+	if err != nil {
+		return nil, "", err
 	}
 
 	// get all the files regardless of ESM mode - we need them for CSS and other file types
-	vUrl := fmt.Sprintf("%s%s@%s", defaultApiBaseURL, name, useVersion)
+	vUrl := fmt.Sprintf("%s%s@%s", c.apiBaseURL, name, useVersion)
 
-	req, err = http.NewRequestWithContext(ctx, http.MethodGet, vUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, vUrl, nil)
 	if err != nil {
 		return nil, "", err
 	}
 
-	resp, err = http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("client api responded with code %d", resp.StatusCode)
+	if err = library.ResponseError(resp, c.Name(), name, useVersion, library.ErrVersionNotFound); err != nil {
+		return nil, "", err
 	}
 
 	var pr PackageResponse
@@ -176,6 +225,157 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 	return files, useVersion, nil
 }
 
+// FetchVersions lists the versions of the package
+func (c *Client) FetchVersions(ctx context.Context, name string) ([]string, error) {
+	var sr SearchResponse
+	err := c.getJSON(ctx, name, "", c.apiBaseURL+name, library.ErrPackageNotFound, &sr)
+	if err != nil {
+		return nil, err
+	}
+
+	return sr.Versions, nil
+}
+
+// FetchDependencies reads the package.json of the package and resolves its dependencies and peer
+// dependencies to exact versions. Without ESM mode the entry is the ES module of the dependency, see
+// Manifest.ModuleEntry, it is empty for dependencies without one.
+func (c *Client) FetchDependencies(ctx context.Context, name, version string) ([]library.Dependency, error) {
+	var manifest Manifest
+	err := c.getJSON(ctx, name, version, fmt.Sprintf("%s%s@%s/package.json", c.cdnBaseURL, name, version), library.ErrFileNotFound, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make(map[string]string)
+	for dep, r := range manifest.PeerDependencies {
+		ranges[dep] = r
+	}
+	for dep, r := range manifest.Dependencies {
+		ranges[dep] = r
+	}
+
+	names := make([]string, 0, len(ranges))
+	for dep := range ranges {
+		names = append(names, dep)
+	}
+	sort.Strings(names)
+
+	deps := make([]library.Dependency, 0, len(names))
+	for _, dep := range names {
+		var rr ResolveResponse
+		err = c.getJSON(ctx, dep, ranges[dep], fmt.Sprintf("%s%s@%s", c.resolveBaseURL, dep, url.PathEscape(ranges[dep])), library.ErrPackageNotFound, &rr)
+		if err != nil {
+			return nil, err
+		}
+
+		if rr.Version == "" {
+			return nil, &library.VersionNotFoundError{Package: dep, Version: ranges[dep]}
+		}
+
+		entry := "esm-bundle.js"
+		if !c.esm {
+			var dm Manifest
+			err = c.getJSON(ctx, dep, rr.Version, fmt.Sprintf("%s%s@%s/package.json", c.cdnBaseURL, dep, rr.Version), library.ErrFileNotFound, &dm)
+			if err != nil {
+				return nil, err
+			}
+
+			// the default file of jsdelivr is usually a UMD or CommonJS build, the browser needs the ES module
+			entry = dm.ModuleEntry()
+		}
+
+		deps = append(deps, library.Dependency{
+			Name:    dep,
+			Version: rr.Version,
+			Entry:   entry,
+		})
+	}
+
+	return deps, nil
+}
+
+// ModuleEntry returns the ES module the package name resolves to in the browser: the browser or import
+// condition of exports["."], the module field, or main of a package of type module. It is empty for
+// packages without one, like types-only packages.
+func (m Manifest) ModuleEntry() string {
+	if entry := exportsEntry(m.Exports, true); entry != "" {
+		return entry
+	}
+
+	if m.Module != "" {
+		return strings.TrimPrefix(path.Clean(m.Module), "/")
+	}
+
+	if m.Type == "module" && m.Main != "" {
+		return strings.TrimPrefix(path.Clean(m.Main), "/")
+	}
+
+	return ""
+}
+
+// moduleConditions are the export conditions that lead to an ES module for the browser, in order of preference
+var moduleConditions = []string{"browser", "import", "module", "default"}
+
+// exportsEntry resolves the "." export of the exports field, root tells whether subpaths may still be listed
+func exportsEntry(raw json.RawMessage, root bool) string {
+	var target string
+	if json.Unmarshal(raw, &target) == nil {
+		if !strings.HasPrefix(target, "./") || strings.HasSuffix(target, ".d.ts") || strings.HasSuffix(target, ".cjs") {
+			return ""
+		}
+		return strings.TrimPrefix(path.Clean(target), "/")
+	}
+
+	var targets []json.RawMessage
+	if json.Unmarshal(raw, &targets) == nil {
+		for _, t := range targets {
+			if entry := exportsEntry(t, false); entry != "" {
+				return entry
+			}
+		}
+		return ""
+	}
+
+	var conditions map[string]json.RawMessage
+	if json.Unmarshal(raw, &conditions) != nil {
+		return ""
+	}
+
+	if dot, ok := conditions["."]; ok && root {
+		return exportsEntry(dot, false)
+	}
+
+	for _, condition := range moduleConditions {
+		if t, ok := conditions[condition]; ok {
+			if entry := exportsEntry(t, false); entry != "" {
+				return entry
+			}
+		}
+	}
+
+	return ""
+}
+
+// getJSON decodes the response of the url into v, a 404 results in a *library.ProviderError wrapping notFound
+func (c *Client) getJSON(ctx context.Context, name, version, url string, notFound error, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = library.ResponseError(resp, c.Name(), name, version, notFound); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
 func walkFiles(files Files, basePath string, filePath string, dist bool) library.Files {
 	var f library.Files
 	for _, file := range files {
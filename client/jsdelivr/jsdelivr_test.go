@@ -2,7 +2,14 @@ package jsdelivr
 
 import (
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/donseba/go-importmap/library"
 )
 
 func TestNew(t *testing.T) {
@@ -30,3 +37,123 @@ func TestNew(t *testing.T) {
 
 	t.Log(string(out))
 }
+
+func TestMirror(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/htmx.org", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"tags":{"latest":"2.0.4"},"versions":["2.0.4","1.9.12"]}`)
+	})
+	mux.HandleFunc("/api/htmx.org@2.0.4", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"default":"/dist/htmx.min.js","files":[{"type":"directory","name":"dist","files":[{"type":"file","name":"htmx.min.js"}]}]}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cdn := New(WithAPIBase(srv.URL+"/api"), WithCDNBase(srv.URL+"/cdn/"))
+
+	f, v, err := cdn.FetchPackageFiles(t.Context(), "htmx.org", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v != "2.0.4" {
+		t.Errorf("version mismatch want 2.0.4 got %s", v)
+	}
+
+	if len(f) != 1 || f[0].Path != srv.URL+"/cdn/htmx.org@2.0.4/dist/htmx.min.js" {
+		t.Errorf("unexpected files %v", f)
+	}
+}
+
+func TestVersionRange(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/htmx.org", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"tags":{"latest":"2.0.4","next":"2.0.0-beta.4"},"versions":["2.0.4","2.0.0-beta.4","1.9.12","1.9.2","1.8.6"]}`)
+	})
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"default":"/dist/htmx.min.js","files":[{"type":"file","name":"htmx.min.js"}]}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cdn := New(WithAPIBase(srv.URL+"/api"), WithCDNBase(srv.URL+"/cdn/"))
+
+	var tests = []struct {
+		version string
+		want    string
+	}{
+		{"^1.9", "1.9.12"},
+		{"~1.8", "1.8.6"},
+		{">=1.9 <2", "1.9.12"},
+		{"next", "2.0.0-beta.4"},
+		{"1.9.2", "1.9.2"},
+	}
+
+	for _, tt := range tests {
+		_, v, err := cdn.FetchPackageFiles(t.Context(), "htmx.org", tt.version)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if v != tt.want {
+			t.Errorf("%s resolved to %s, want %s", tt.version, v, tt.want)
+		}
+	}
+
+	_, _, err := cdn.FetchPackageFiles(t.Context(), "htmx.org", "^3")
+	if err == nil {
+		t.Error("expected an error when no version matches")
+	}
+}
+
+func TestFetchDependencies(t *testing.T) {
+	manifests := map[string]string{
+		"app@1.0.0":        `{"dependencies":{"preact":"^10.0.0","legacy":"^2.0.0","native":"^1.0.0","types-only":"^1.0.0"}}`,
+		"preact@10.0.0":    `{"main":"dist/preact.js","module":"dist/preact.module.js","exports":{".":{"types":"./src/index.d.ts","browser":"./dist/preact.module.js","import":"./dist/preact.mjs","require":"./dist/preact.js"},"./hooks":{"import":"./hooks/dist/hooks.mjs"}}}`,
+		"legacy@2.0.0":     `{"main":"lib/index.js","module":"es/index.js"}`,
+		"native@1.0.0":     `{"type":"module","main":"./index.js","exports":[{"import":"./src/index.js"},"./index.js"]}`,
+		"types-only@1.0.0": `{"types":"index.d.ts","exports":{".":{"types":"./index.d.ts"}}}`,
+	}
+
+	versions := map[string]string{"preact": "10.0.0", "legacy": "2.0.0", "native": "1.0.0", "types-only": "1.0.0"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cdn/", func(w http.ResponseWriter, r *http.Request) {
+		manifest, ok := manifests[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/cdn/"), "/package.json")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, manifest)
+	})
+	mux.HandleFunc("/resolve/", func(w http.ResponseWriter, r *http.Request) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/resolve/"), "@")
+		_, _ = io.WriteString(w, `{"version":"`+versions[name]+`"}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cdn := New(WithAPIBase(srv.URL+"/api"), WithResolveBase(srv.URL+"/resolve"), WithCDNBase(srv.URL+"/cdn"))
+
+	deps, err := cdn.FetchDependencies(t.Context(), "app", "1.0.0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := []library.Dependency{
+		{Name: "legacy", Version: "2.0.0", Entry: "es/index.js"},
+		{Name: "native", Version: "1.0.0", Entry: "src/index.js"},
+		{Name: "preact", Version: "10.0.0", Entry: "dist/preact.module.js"},
+		{Name: "types-only", Version: "1.0.0"},
+	}
+
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("got %+v, want %+v", deps, want)
+	}
+}
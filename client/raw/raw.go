@@ -18,6 +18,11 @@ func New(url string) *Provider {
 	return &Provider{URL: url}
 }
 
+// Name returns the name of the provider
+func (p *Provider) Name() string {
+	return "raw"
+}
+
 // FetchPackageFiles returns a single file with the raw URL.
 // The version is passed through unchanged.
 func (p *Provider) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
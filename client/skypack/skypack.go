@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/donseba/go-importmap/library"
 )
@@ -20,12 +21,18 @@ type Client struct {
 	packageApiBaseURL string
 	browseApiBaseURL  string
 	cdnBaseURL        string
+	httpClient        *http.Client
 }
 
+// Option configures the Client.
+type Option func(*Client)
+
 // PackageResponse represents the response structure from /v1/package/{name}.
 type PackageResponse struct {
-	Name    string `json:"name"`
-	Version string `json:"version"`
+	Name     string            `json:"name"`
+	Version  string            `json:"version"`
+	DistTags map[string]string `json:"distTags"`
+	Versions map[string]string `json:"versions"` // version to release date
 }
 
 // BrowseResponse represents the response structure from /v1/browse/{name}/{version}.
@@ -41,61 +48,103 @@ type FileInfo struct {
 }
 
 // New creates a new Skypack client.
-func New() *Client {
-	return &Client{
+func New(opts ...Option) *Client {
+	c := &Client{
 		packageApiBaseURL: defaultPackageApiBaseURL,
 		browseApiBaseURL:  defaultBrowseApiBaseURL,
 		cdnBaseURL:        defaultCdnBaseURL,
+		httpClient:        http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// WithHTTPClient sets the http client used for all requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.SetHTTPClient(hc)
+	}
+}
+
+// WithPackageAPIBase sets the base URL of the package API, e.g. a mirror of https://api.skypack.dev/v1/package/.
+func WithPackageAPIBase(u string) Option {
+	return func(c *Client) {
+		c.packageApiBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+}
+
+// WithBrowseAPIBase sets the base URL of the browse API, e.g. a mirror of https://api.skypack.dev/v1/browse/.
+func WithBrowseAPIBase(u string) Option {
+	return func(c *Client) {
+		c.browseApiBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+}
+
+// WithCDNBase sets the base URL the package files are served from, e.g. a mirror of https://cdn.skypack.dev/.
+func WithCDNBase(u string) Option {
+	return func(c *Client) {
+		c.cdnBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
 }
 
+// SetHTTPClient sets the http client used for all requests, nil restores http.DefaultClient.
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c.httpClient = hc
+}
+
+// HTTPClient returns the http client used for all requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Name returns the name of the provider
+func (c *Client) Name() string {
+	return "skypack"
+}
+
 // FetchPackageFiles retrieves package metadata and file list from Skypack.
 // It first calls the package endpoint to determine the package version (if not explicitly provided)
 // and then calls the browse endpoint to retrieve the list of files.
 func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
 	// Get package metadata from /v1/package/{name}
-	packageURL := c.packageApiBaseURL + name
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, packageURL, nil)
+	pr, err := c.packageInfo(ctx, name, version)
 	if err != nil {
 		return nil, "", err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("Skypack package API responded with code %d", resp.StatusCode)
+	// Resolve the version, tag or range against the published versions.
+	tags := pr.DistTags
+	if tags == nil {
+		tags = map[string]string{"latest": pr.Version}
 	}
 
-	var pr PackageResponse
-	if err = json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+	useVersion, err := library.ResolveVersion(name, version, pr.versions(), tags)
+	if err != nil {
 		return nil, "", err
 	}
 
-	// Determine which version to use.
-	useVersion := pr.Version
-	if version != "" && version != useVersion {
-		useVersion = version
-	}
-
 	// Get file list from /v1/browse/{name}/{version}
 	browseURL := fmt.Sprintf("%s%s/%s", c.browseApiBaseURL, name, useVersion)
-	req, err = http.NewRequestWithContext(ctx, http.MethodGet, browseURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, browseURL, nil)
 	if err != nil {
 		return nil, "", err
 	}
 
-	resp, err = http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("skypack browse API responded with code %d", resp.StatusCode)
+	if err = library.ResponseError(resp, c.Name(), name, useVersion, library.ErrVersionNotFound); err != nil {
+		return nil, "", err
 	}
 
 	var br BrowseResponse
@@ -105,10 +154,15 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 
 	var files library.Files
 	for _, fileInfo := range br.Files {
-		// Construct a file entry using the URL returned in the response.
+		// Construct a file entry using the URL returned in the response, relative URLs are served by the CDN.
+		fileURL := fileInfo.URL
+		if strings.HasPrefix(fileURL, "/") {
+			fileURL = c.cdnBaseURL + strings.TrimPrefix(fileURL, "/")
+		}
+
 		files = append(files, library.File{
 			Type:      library.ExtractFileType(fileInfo.Name),
-			Path:      fileInfo.URL,
+			Path:      fileURL,
 			LocalPath: fileInfo.Name,
 		})
 	}
@@ -125,3 +179,46 @@ func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (l
 
 	return files, useVersion, nil
 }
+
+// FetchVersions lists the versions of the package
+func (c *Client) FetchVersions(ctx context.Context, name string) ([]string, error) {
+	pr, err := c.packageInfo(ctx, name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return pr.versions(), nil
+}
+
+// packageInfo retrieves the package metadata, the version is only used in errors
+func (c *Client) packageInfo(ctx context.Context, name, version string) (PackageResponse, error) {
+	var pr PackageResponse
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.packageApiBaseURL+name, nil)
+	if err != nil {
+		return pr, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return pr, err
+	}
+	defer resp.Body.Close()
+
+	if err = library.ResponseError(resp, c.Name(), name, version, library.ErrPackageNotFound); err != nil {
+		return pr, err
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&pr)
+	return pr, err
+}
+
+// versions returns the published versions of the package
+func (pr PackageResponse) versions() []string {
+	versions := make([]string, 0, len(pr.Versions))
+	for v := range pr.Versions {
+		versions = append(versions, v)
+	}
+
+	return versions
+}
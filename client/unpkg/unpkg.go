@@ -11,12 +11,21 @@ import (
 )
 
 var (
-	defaultApiBaseURL = "https://unpkg.com/%s@%s/?meta" // Package name + version
-	defaultCdnBaseURL = "https://unpkg.com/%s@%s/"      // Base CDN URL
+	defaultApiBaseURL      = "https://unpkg.com/"          // Meta API, {base}{name}@{version}/?meta
+	defaultCdnBaseURL      = "https://unpkg.com/"          // Base CDN URL, {base}{name}@{version}/{file}
+	defaultRegistryBaseURL = "https://registry.npmjs.org/" // npm registry used to resolve versions
 )
 
 type (
-	Client struct{}
+	Client struct {
+		apiBaseURL      string
+		cdnBaseURL      string
+		registryBaseURL string
+		httpClient      *http.Client
+	}
+
+	// Option configures the Client
+	Option func(*Client)
 
 	UnpkgMetaResponse struct {
 		Type  string             `json:"type"`
@@ -30,71 +39,109 @@ type (
 	}
 )
 
-func New() *Client {
-	return &Client{}
+func New(opts ...Option) *Client {
+	c := &Client{
+		apiBaseURL:      defaultApiBaseURL,
+		cdnBaseURL:      defaultCdnBaseURL,
+		registryBaseURL: defaultRegistryBaseURL,
+		httpClient:      http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
-func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
-	// Resolve latest version if not specified
-	if version == "" {
-		versionResp, err := c.getLatestVersion(ctx, name)
-		if err != nil {
-			return nil, "", err
-		}
-		version = versionResp
+// WithHTTPClient sets the http client used for all requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.SetHTTPClient(hc)
 	}
+}
 
-	// Get file listing from Unpkg's meta API
-	metaUrl := fmt.Sprintf(defaultApiBaseURL, name, version)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metaUrl, nil)
-	if err != nil {
-		return nil, "", err
+// WithAPIBase sets the base URL of the meta API, e.g. a mirror of https://unpkg.com/
+func WithAPIBase(u string) Option {
+	return func(c *Client) {
+		c.apiBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, "", err
+// WithCDNBase sets the base URL the package files are served from, e.g. a mirror of https://unpkg.com/
+func WithCDNBase(u string) Option {
+	return func(c *Client) {
+		c.cdnBaseURL = strings.TrimSuffix(u, "/") + "/"
 	}
-	defer resp.Body.Close()
+}
+
+// WithRegistryBase sets the base URL of the npm registry used to resolve versions, e.g. a mirror of https://registry.npmjs.org/
+func WithRegistryBase(u string) Option {
+	return func(c *Client) {
+		c.registryBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("unpkg API responded with status %d", resp.StatusCode)
+// SetHTTPClient sets the http client used for all requests, nil restores http.DefaultClient
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
 	}
+	c.httpClient = hc
+}
 
-	var meta UnpkgMetaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+// HTTPClient returns the http client used for all requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Name returns the name of the provider
+func (c *Client) Name() string {
+	return "unpkg"
+}
+
+func (c *Client) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
+	// Resolve the version, tag or range against the npm registry
+	version, err := c.registry().Resolve(ctx, name, version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Get file listing from Unpkg's meta API
+	metaBase := fmt.Sprintf("%s%s@%s/", c.apiBaseURL, name, version)
+	meta, err := c.meta(ctx, name, version, metaBase+"?meta")
+	if err != nil {
 		return nil, "", err
 	}
 
 	// Build base CDN URL
-	basePath := fmt.Sprintf(defaultCdnBaseURL, name, version)
+	basePath := fmt.Sprintf("%s%s@%s/", c.cdnBaseURL, name, version)
 
 	// Recursively collect all files
 	var files library.Files
-	c.walkFiles(meta.Files, basePath, &files)
+	err = c.walkFiles(ctx, name, version, meta.Files, metaBase, basePath, &files)
+	if err != nil {
+		return nil, "", err
+	}
 
 	return files, version, nil
 }
 
-func (c *Client) walkFiles(listings []UnpkgFileListing, basePath string, files *library.Files) {
+// walkFiles collects the files of the listing, directories are listed with additional meta requests
+func (c *Client) walkFiles(ctx context.Context, name, version string, listings []UnpkgFileListing, metaBase, basePath string, files *library.Files) error {
 	for _, item := range listings {
 		if item.Type == "directory" {
 			// Recursively process nested directories
-			subUrl := fmt.Sprintf("%s%s/?meta", basePath, item.Path)
-			subReq, _ := http.NewRequest("GET", subUrl, nil)
-			resp, err := http.DefaultClient.Do(subReq)
+			subUrl := fmt.Sprintf("%s%s/?meta", metaBase, strings.TrimPrefix(item.Path, "/"))
+			subdir, err := c.meta(ctx, name, version, subUrl)
 			if err != nil {
-				continue
+				return err
 			}
 
-			var subdir UnpkgMetaResponse
-			err = json.NewDecoder(resp.Body).Decode(&subdir)
+			err = c.walkFiles(ctx, name, version, subdir.Files, metaBase, basePath, files)
 			if err != nil {
-				continue
+				return err
 			}
-			resp.Body.Close()
-
-			c.walkFiles(subdir.Files, basePath, files)
 		} else {
 			// Add the file with proper typing to the list
 			*files = append(*files, library.File{
@@ -104,26 +151,40 @@ func (c *Client) walkFiles(listings []UnpkgFileListing, basePath string, files *
 			})
 		}
 	}
+
+	return nil
 }
 
-// Helper to get latest version from npm registry
-func (c *Client) getLatestVersion(ctx context.Context, name string) (string, error) {
-	registryUrl := fmt.Sprintf("https://registry.npmjs.org/%s", name)
-	resp, err := http.Get(registryUrl)
+// meta retrieves a file listing from the meta API
+func (c *Client) meta(ctx context.Context, name, version, metaUrl string) (UnpkgMetaResponse, error) {
+	var meta UnpkgMetaResponse
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metaUrl, nil)
 	if err != nil {
-		return "", err
+		return meta, err
 	}
-	defer resp.Body.Close()
 
-	var pkg struct {
-		DistTags struct {
-			Latest string `json:"latest"`
-		} `json:"dist-tags"`
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return meta, err
 	}
+	defer resp.Body.Close()
 
-	if err := json.NewDecoder(resp.Body).Decode(&pkg); err != nil {
-		return "", err
+	if err = library.ResponseError(resp, c.Name(), name, version, library.ErrPackageNotFound); err != nil {
+		return meta, err
 	}
 
-	return pkg.DistTags.Latest, nil
+	err = json.NewDecoder(resp.Body).Decode(&meta)
+	return meta, err
+}
+
+// FetchVersions lists the versions of the package in the npm registry
+func (c *Client) FetchVersions(ctx context.Context, name string) ([]string, error) {
+	versions, _, err := c.registry().Versions(ctx, name, "")
+	return versions, err
+}
+
+// registry returns the npm registry the versions are resolved against
+func (c *Client) registry() library.Registry {
+	return library.Registry{BaseURL: c.registryBaseURL, Client: c.httpClient, Provider: c.Name()}
 }
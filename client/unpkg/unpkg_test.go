@@ -2,7 +2,13 @@ package unpkg
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/donseba/go-importmap/library"
 )
 
 func TestNew(t *testing.T) {
@@ -30,3 +36,39 @@ func TestNew(t *testing.T) {
 
 	t.Log(string(out))
 }
+
+func TestWalkFilesError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/registry/lib", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{}}}`)
+	})
+	mux.HandleFunc("/meta/lib@1.0.0/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/meta/lib@1.0.0/dist/" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = io.WriteString(w, `{"type":"directory","path":"/","files":[{"path":"/index.js","type":"file"},{"path":"/dist","type":"directory"}]}`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cdn := New(WithRegistryBase(srv.URL+"/registry"), WithAPIBase(srv.URL+"/meta"), WithCDNBase(srv.URL+"/cdn"))
+
+	_, _, err := cdn.FetchPackageFiles(t.Context(), "lib", "")
+
+	var providerErr *library.ProviderError
+	if !errors.As(err, &providerErr) || !errors.Is(err, library.ErrRateLimited) {
+		t.Errorf("expected a rate limited ProviderError, got %v", err)
+		return
+	}
+
+	if providerErr.Provider != "unpkg" || providerErr.Package != "lib" || providerErr.Version != "1.0.0" || providerErr.StatusCode != http.StatusTooManyRequests || providerErr.URL != srv.URL+"/meta/lib@1.0.0/dist/?meta" {
+		t.Errorf("unexpected error %+v", providerErr)
+	}
+
+	_, _, err = cdn.FetchPackageFiles(t.Context(), "unknown", "")
+	if !errors.Is(err, library.ErrPackageNotFound) {
+		t.Errorf("expected ErrPackageNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+// Command importmap manages the packages of an import map without writing Go code. The packages are
+// described in a config file, importmap.json by default, which is read and updated by every command.
+//
+// Usage:
+//
+//	importmap [-config importmap.json] <command> [arguments]
+//
+// The commands are:
+//
+//	pin      add packages to the config and vendor them, e.g. pin -require htmx.min.js htmx@2.0.4
+//	unpin    remove packages from the config and the lockfile
+//	update   resolve packages again, ranges and tags are kept, exact versions are replaced by the latest one
+//	vendor   download all packages into the cache and assets dirs
+//	outdated list the packages with newer versions, with -all every package is listed
+//	json     print the import map as JSON
+//	render   print the html of the import map, the shim and the stylesheets
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/donseba/go-importmap"
+	"github.com/donseba/go-importmap/library"
+)
+
+const defaultConfigFile = "importmap.json"
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, config string, args []string, stdout io.Writer) error
+}
+
+var commands = []command{
+	{name: "pin", usage: "pin [-provider name] [-url url] [-scope prefix] [-require file[:as]]... package[@version]...", run: pin},
+	{name: "unpin", usage: "unpin [-scope prefix] package...", run: unpin},
+	{name: "update", usage: "update [package...]", run: update},
+	{name: "vendor", usage: "vendor", run: vendor},
+	{name: "outdated", usage: "outdated [-all]", run: outdated},
+	{name: "json", usage: "json", run: printJSON},
+	{name: "render", usage: "render", run: render},
+}
+
+func main() {
+	err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "importmap:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("importmap", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	config := fs.String("config", defaultConfigFile, "path of the config file")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: importmap [-config importmap.json] <command> [arguments]")
+		fmt.Fprintln(stderr, "\ncommands:")
+		for _, c := range commands {
+			fmt.Fprintln(stderr, "  "+c.usage)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	for _, c := range commands {
+		if c.name == fs.Arg(0) {
+			return c.run(ctx, *config, fs.Args()[1:], stdout)
+		}
+	}
+
+	fs.Usage()
+	return fmt.Errorf("unknown command %q", fs.Arg(0))
+}
+
+// includes collects the repeated -require flag, every value is a file optionally followed by its specifier
+type includes []importmap.IncludeConfig
+
+func (i *includes) String() string {
+	var s []string
+	for _, ic := range *i {
+		s = append(s, ic.File+":"+ic.As)
+	}
+	return strings.Join(s, ",")
+}
+
+func (i *includes) Set(value string) error {
+	file, as, _ := strings.Cut(value, ":")
+	if file == "" {
+		return errors.New("the file of a require is empty")
+	}
+
+	*i = append(*i, importmap.IncludeConfig{File: file, As: as})
+	return nil
+}
+
+// splitVersion splits package@version, the @ of a scoped npm package like @hotwired/stimulus is kept
+func splitVersion(arg string) (string, string) {
+	if i := strings.LastIndex(arg, "@"); i > 0 {
+		return arg[:i], arg[i+1:]
+	}
+
+	return arg, ""
+}
+
+// readConfig reads the config, a missing file results in an empty config so the first pin creates it
+func readConfig(name string) (*importmap.Config, error) {
+	cfg, err := importmap.ReadConfig(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return &importmap.Config{}, nil
+	}
+
+	return cfg, err
+}
+
+func pin(ctx context.Context, config string, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("pin", flag.ContinueOnError)
+	provider := fs.String("provider", "", "provider of the packages, defaults to the provider of the config")
+	url := fs.String("url", "", "url of the file when the provider is raw")
+	scope := fs.String("scope", "", "url prefix in which the packages are mapped")
+	var require includes
+	fs.Var(&require, "require", "file to import, optionally followed by :specifier, can be repeated")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("pin: no packages given")
+	}
+
+	cfg, err := readConfig(config)
+	if err != nil {
+		return err
+	}
+
+	var pinned []importmap.PackageConfig
+	for _, arg := range fs.Args() {
+		name, version := splitVersion(arg)
+
+		pc := importmap.PackageConfig{Name: name, Scope: *scope}
+		if existing := cfg.Get(name, *scope); existing != nil {
+			pc = *existing
+		}
+
+		pc.Version = version
+		if *provider != "" {
+			pc.Provider = *provider
+		}
+		if *url != "" {
+			pc.URL = *url
+		}
+		if len(require) > 0 {
+			pc.Require = require
+		}
+
+		cfg.Set(pc)
+		pinned = append(pinned, pc)
+	}
+
+	err = resolve(ctx, cfg, config, pinned)
+	if err != nil {
+		return err
+	}
+
+	for _, pc := range pinned {
+		pc = *cfg.Get(pc.Name, pc.Scope)
+		fmt.Fprintf(stdout, "pinned %s\n", label(pc))
+	}
+
+	return cfg.Write(config)
+}
+
+func unpin(ctx context.Context, config string, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("unpin", flag.ContinueOnError)
+	scope := fs.String("scope", "", "url prefix in which the packages are mapped")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("unpin: no packages given")
+	}
+
+	cfg, err := importmap.ReadConfig(config)
+	if err != nil {
+		return err
+	}
+
+	im, err := importMap(cfg, config)
+	if err != nil {
+		return err
+	}
+
+	lock, err := im.Lock()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range fs.Args() {
+		name, _ := splitVersion(arg)
+		if !cfg.Remove(name, *scope) {
+			return fmt.Errorf("unpin: %s is not pinned", name)
+		}
+		if lock != nil {
+			lock.Remove(name, *scope)
+		}
+
+		fmt.Fprintf(stdout, "unpinned %s\n", name)
+	}
+
+	err = im.SaveLock(lock)
+	if err != nil {
+		return err
+	}
+
+	return cfg.Write(config)
+}
+
+func update(ctx context.Context, config string, args []string, stdout io.Writer) error {
+	cfg, err := importmap.ReadConfig(config)
+	if err != nil {
+		return err
+	}
+
+	var packages []importmap.PackageConfig
+	if len(args) == 0 {
+		packages = append(packages, cfg.Packages...)
+	}
+	for _, arg := range args {
+		name, _ := splitVersion(arg)
+
+		found := false
+		for _, pc := range cfg.Packages {
+			if pc.Name == name {
+				packages = append(packages, pc)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("update: %s is not pinned", name)
+		}
+	}
+
+	im, err := importMap(cfg, config)
+	if err != nil {
+		return err
+	}
+
+	lock, err := im.Lock()
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]string)
+	for i, pc := range packages {
+		previous[pc.Scope+" "+pc.Name] = lockedVersion(lock, pc)
+
+		// an exact version is replaced by the latest one, ranges and tags stay and are resolved again
+		if _, err := library.ParseVersion(pc.Version); err == nil {
+			packages[i].Version = ""
+			cfg.Set(packages[i])
+		}
+
+		if lock != nil {
+			lock.Remove(pc.Name, pc.Scope)
+		}
+	}
+
+	err = im.SaveLock(lock)
+	if err != nil {
+		return err
+	}
+
+	err = resolve(ctx, cfg, config, packages)
+	if err != nil {
+		return err
+	}
+
+	lock, err = im.Lock()
+	if err != nil {
+		return err
+	}
+
+	for _, pc := range packages {
+		pc = *cfg.Get(pc.Name, pc.Scope)
+		if old, current := previous[pc.Scope+" "+pc.Name], lockedVersion(lock, pc); old != current {
+			fmt.Fprintf(stdout, "updated %s from %s to %s\n", label(pc), old, current)
+		}
+	}
+
+	return cfg.Write(config)
+}
+
+// lockedVersion returns the version the package is locked to, its configured version without a lock entry
+func lockedVersion(lock *importmap.Lock, pc importmap.PackageConfig) string {
+	if lp := lock.Get(pc.Name, pc.Scope); lp != nil {
+		return lp.Version
+	}
+
+	return pc.Version
+}
+
+func vendor(ctx context.Context, config string, _ []string, _ io.Writer) error {
+	im, err := load(config)
+	if err != nil {
+		return err
+	}
+
+	return im.Fetch(ctx)
+}
+
+func outdated(ctx context.Context, config string, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("outdated", flag.ContinueOnError)
+	all := fs.Bool("all", false, "list up to date packages as well")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	im, err := load(config)
+	if err != nil {
+		return err
+	}
+
+	packages, err := im.Outdated(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "package\tcurrent\tpatch\tminor\tlatest")
+
+	listed := 0
+	for _, p := range packages {
+		if !*all && !p.Outdated() {
+			continue
+		}
+
+		name := p.Name
+		if p.Scope != "" {
+			name += " (scope " + p.Scope + ")"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, p.Current, p.Patch, p.Minor, p.Major)
+		listed++
+	}
+
+	if listed == 0 {
+		_, err = fmt.Fprintln(stdout, "all packages are up to date")
+		return err
+	}
+
+	return tw.Flush()
+}
+
+func printJSON(ctx context.Context, config string, _ []string, stdout io.Writer) error {
+	im, err := load(config)
+	if err != nil {
+		return err
+	}
+
+	err = im.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	out, err := im.ImportsIndent()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, out)
+	return err
+}
+
+func render(ctx context.Context, config string, _ []string, stdout io.Writer) error {
+	im, err := load(config)
+	if err != nil {
+		return err
+	}
+
+	err = im.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	out, err := im.Render()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, out)
+	return err
+}
+
+func load(config string) (*importmap.ImportMap, error) {
+	return importmap.LoadConfig(config)
+}
+
+// importMap returns the ImportMap of the config, a relative root dir is relative to the config file
+func importMap(cfg *importmap.Config, config string) (*importmap.ImportMap, error) {
+	c := *cfg
+	if !filepath.IsAbs(c.RootDir) {
+		c.RootDir = filepath.Join(filepath.Dir(config), c.RootDir)
+	}
+
+	return c.ImportMap()
+}
+
+// resolve fetches the config, packages without a version are resolved again and pinned to the version
+// the provider returned
+func resolve(ctx context.Context, cfg *importmap.Config, config string, packages []importmap.PackageConfig) error {
+	im, err := importMap(cfg, config)
+	if err != nil {
+		return err
+	}
+
+	lock, err := im.Lock()
+	if err != nil {
+		return err
+	}
+
+	if lock != nil {
+		for _, pc := range packages {
+			if pc.Version == "" {
+				lock.Remove(pc.Name, pc.Scope)
+			}
+		}
+
+		err = im.SaveLock(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = im.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	lock, err = im.Lock()
+	if err != nil || lock == nil {
+		return err
+	}
+
+	for _, pc := range packages {
+		lp := lock.Get(pc.Name, pc.Scope)
+		if pc.Version == "" && lp != nil {
+			pc.Version = lp.Version
+			cfg.Set(pc)
+		}
+	}
+
+	return nil
+}
+
+func label(pc importmap.PackageConfig) string {
+	s := pc.Name
+	if pc.Version != "" {
+		s += "@" + pc.Version
+	}
+	if pc.Scope != "" {
+		s += " (scope " + pc.Scope + ")"
+	}
+	return s
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/donseba/go-importmap"
+)
+
+func TestRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	config := filepath.Join(t.TempDir(), "importmap.json")
+
+	exec := func(args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		err := run(t.Context(), append([]string{"-config", config}, args...), &stdout, &stderr)
+		return stdout.String(), err
+	}
+
+	out, err := exec("pin", "-provider", "raw", "-url", srv.URL+"/lib.js", "lib@1.0.0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if out != "pinned lib@1.0.0\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	cfg, err := importmap.ReadConfig(config)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if pc := cfg.Get("lib", ""); pc == nil || pc.Version != "1.0.0" || pc.Provider != "raw" {
+		t.Errorf("unexpected config %+v", cfg.Packages)
+	}
+
+	out, err = exec("json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(out, `"lib": "/assets/lib/lib"`) {
+		t.Errorf("unexpected import map %s", out)
+	}
+
+	lock, err := importmap.ReadLock(filepath.Join(filepath.Dir(config), "importmap.lock.json"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if lock.Get("lib", "") == nil {
+		t.Error("lib is not locked")
+	}
+
+	// pinning another version replaces the asset that is served
+	_, err = exec("pin", "-url", srv.URL+"/v2/lib.js", "lib@2.0.0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	asset, err := os.ReadFile(filepath.Join(filepath.Dir(config), "assets", "lib", "lib"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(asset) != "/v2/lib.js" {
+		t.Errorf("the asset still holds %q", asset)
+	}
+
+	// update keeps a range in the config and resolves it again, an exact version is replaced
+	_, err = exec("pin", "-provider", "raw", "-url", srv.URL+"/range.js", "range@^1.9")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = exec("update")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg, err = importmap.ReadConfig(config)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if pc := cfg.Get("range", ""); pc == nil || pc.Version != "^1.9" {
+		t.Errorf("expected the range to stay, got %+v", pc)
+	}
+	if pc := cfg.Get("lib", ""); pc == nil || pc.Version == "2.0.0" {
+		t.Errorf("expected the exact version to be replaced, got %+v", pc)
+	}
+
+	_, err = exec("unpin", "range")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = exec("unpin", "lib")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg, _ = importmap.ReadConfig(config)
+	lock, _ = importmap.ReadLock(filepath.Join(filepath.Dir(config), "importmap.lock.json"))
+	if len(cfg.Packages) != 0 || lock.Get("lib", "") != nil {
+		t.Errorf("lib is still pinned: %+v %+v", cfg.Packages, lock.Packages)
+	}
+
+	_, err = exec("unpin", "lib")
+	if err == nil {
+		t.Error("expected an error when unpinning a package that is not pinned")
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	var tests = []struct {
+		arg, name, version string
+	}{
+		{"htmx", "htmx", ""},
+		{"htmx@2.0.4", "htmx", "2.0.4"},
+		{"@hotwired/stimulus", "@hotwired/stimulus", ""},
+		{"@hotwired/stimulus@3.2.2", "@hotwired/stimulus", "3.2.2"},
+	}
+
+	for _, tt := range tests {
+		name, version := splitVersion(tt.arg)
+		if name != tt.name || version != tt.version {
+			t.Errorf("splitVersion(%q) = %q, %q, want %q, %q", tt.arg, name, version, tt.name, tt.version)
+		}
+	}
+}
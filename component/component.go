@@ -0,0 +1,81 @@
+// Package component renders the parts of an import map in templ templates. The components implement the
+// templ.Component interface, Render(ctx, io.Writer) error, without this module depending on templ:
+//
+//	<head>
+//		@component.Head(im, importmap.RenderOptions{Nonce: templ.GetNonce(ctx), Preload: []string{"app"}})
+//	</head>
+package component
+
+import (
+	"context"
+	"html/template"
+	"io"
+
+	"github.com/donseba/go-importmap"
+)
+
+type (
+	// Component is the interface of templ.Component
+	Component interface {
+		Render(ctx context.Context, w io.Writer) error
+	}
+
+	// Func is a function implementing Component
+	Func func(ctx context.Context, w io.Writer) error
+)
+
+func (f Func) Render(ctx context.Context, w io.Writer) error {
+	return f(ctx, w)
+}
+
+// Head renders the stylesheets, the shim, the import map and the preloads, see ImportMap.RenderWith
+func Head(im *importmap.ImportMap, opts importmap.RenderOptions) Component {
+	return render(func() (template.HTML, error) {
+		return im.RenderWith(opts)
+	})
+}
+
+// ImportMap renders the import map script tag
+func ImportMap(im *importmap.ImportMap, opts importmap.RenderOptions) Component {
+	return render(func() (template.HTML, error) {
+		return im.RenderImportMap(opts)
+	})
+}
+
+// Styles renders the stylesheet links
+func Styles(im *importmap.ImportMap, opts importmap.RenderOptions) Component {
+	return render(func() (template.HTML, error) {
+		return im.RenderStyles(opts)
+	})
+}
+
+// Shim renders the script tag of the ES module shim
+func Shim(im *importmap.ImportMap, opts importmap.RenderOptions) Component {
+	return render(func() (template.HTML, error) {
+		return im.RenderShim(opts), nil
+	})
+}
+
+// Preload renders the modulepreload links of opts.Preload and every module they import statically
+func Preload(im *importmap.ImportMap, opts importmap.RenderOptions) Component {
+	return render(func() (template.HTML, error) {
+		return im.RenderPreloads(opts)
+	})
+}
+
+// render writes the html when the component is rendered, so it reflects the ImportMap at that time
+func render(html func() (template.HTML, error)) Component {
+	return Func(func(ctx context.Context, w io.Writer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		out, err := html()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(w, string(out))
+		return err
+	})
+}
@@ -0,0 +1,53 @@
+package component
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/donseba/go-importmap"
+)
+
+func TestComponents(t *testing.T) {
+	im := importmap.New().ShimPath("/shim.js")
+	im.Structure.Imports["app"] = "/assets/app.js"
+	im.Structure.Styles["ui"] = "/assets/ui.css"
+
+	opts := importmap.RenderOptions{Nonce: "n0nce"}
+
+	var tests = []struct {
+		name      string
+		component Component
+		want      string
+	}{
+		{"styles", Styles(im, opts), `<link rel="stylesheet" href="/assets/ui.css" as="ui" nonce="n0nce"/>`},
+		{"shim", Shim(im, opts), `<script async src="/shim.js" nonce="n0nce"></script>`},
+		{"importmap", ImportMap(im, opts), "<script type=\"importmap\" nonce=\"n0nce\">\n{\n  \"imports\": {\n    \"app\": \"/assets/app.js\"\n  }\n}\n</script>"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := tt.component.Render(t.Context(), &buf); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if buf.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, buf.String(), tt.want)
+		}
+	}
+
+	var head bytes.Buffer
+	if err := Head(im, opts).Render(t.Context(), &head); err != nil {
+		t.Error(err)
+		return
+	}
+
+	want, _ := im.RenderWith(opts)
+	if head.String() != string(want) {
+		t.Errorf("unexpected head %q", head.String())
+	}
+
+	if err := Preload(im, importmap.RenderOptions{Preload: []string{"missing"}}).Render(t.Context(), &head); err == nil {
+		t.Error("expected an error for an unknown specifier")
+	}
+}
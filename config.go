@@ -0,0 +1,246 @@
+package importmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/donseba/go-importmap/client/cdnjs"
+	"github.com/donseba/go-importmap/client/esmsh"
+	"github.com/donseba/go-importmap/client/jsdelivr"
+	"github.com/donseba/go-importmap/client/raw"
+	"github.com/donseba/go-importmap/client/skypack"
+	"github.com/donseba/go-importmap/client/unpkg"
+	"github.com/donseba/go-importmap/library"
+)
+
+type (
+	// Config is the project file describing the import map, empty fields fall back to the defaults
+	Config struct {
+		Provider      string              `json:"provider,omitempty"`
+		RootDir       string              `json:"rootDir,omitempty"`
+		AssetsDir     string              `json:"assetsDir,omitempty"`
+		CacheDir      string              `json:"cacheDir,omitempty"`
+		LockFile      string              `json:"lockFile,omitempty"`
+		Shim          string              `json:"shim,omitempty"`
+		Integrity     string              `json:"integrity,omitempty"`
+		Dependencies  bool                `json:"dependencies,omitempty"`
+		Fingerprint   bool                `json:"fingerprint,omitempty"`
+		Retries       int                 `json:"retries,omitempty"`       // retries of requests failing with a 429 or 5xx after the first attempt, 0 disables retries
+		MetadataCache string              `json:"metadataCache,omitempty"` // ttl of the provider metadata cache like 1h, 0s always revalidates
+		Entrypoints   map[string][]string `json:"entrypoints,omitempty"`   // specifiers or package names by entrypoint, see ImportMap.WithEntrypoint
+		Packages      []PackageConfig     `json:"packages"`
+	}
+
+	// PackageConfig describes a single package, Provider overrides the provider of the config
+	PackageConfig struct {
+		Name     string          `json:"name"`
+		Version  string          `json:"version,omitempty"`
+		Provider string          `json:"provider,omitempty"`
+		URL      string          `json:"url,omitempty"` // source of the raw provider
+		Scope    string          `json:"scope,omitempty"`
+		Require  []IncludeConfig `json:"require,omitempty"`
+	}
+
+	// IncludeConfig describes a file of the package that is added to the import map
+	IncludeConfig struct {
+		File  string `json:"file,omitempty"`
+		Raw   string `json:"raw,omitempty"`
+		As    string `json:"as,omitempty"`
+		Order int    `json:"order,omitempty"` // position of a stylesheet, lower renders first
+	}
+)
+
+// NewProvider returns the provider with the given name: cdnjs, jsdelivr, jsdelivr-esm, unpkg, skypack,
+// esmsh or raw. The url is only used by the raw provider.
+func NewProvider(name string, url string) (library.Provider, error) {
+	switch name {
+	case "cdnjs":
+		return cdnjs.New(), nil
+	case "jsdelivr":
+		return jsdelivr.New(), nil
+	case "jsdelivr-esm":
+		return jsdelivr.NewESM(), nil
+	case "unpkg":
+		return unpkg.New(), nil
+	case "skypack":
+		return skypack.New(), nil
+	case "esmsh":
+		return esmsh.New(), nil
+	case "raw":
+		if url == "" {
+			return nil, errors.New("the raw provider requires a url")
+		}
+		return raw.New(url), nil
+	}
+
+	return nil, fmt.Errorf("unknown provider %q", name)
+}
+
+// LoadConfig reads and validates the config file and returns the configured ImportMap. A relative root dir
+// is relative to the directory of the config file.
+func LoadConfig(name string) (*ImportMap, error) {
+	c, err := ReadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !filepath.IsAbs(c.RootDir) {
+		c.RootDir = filepath.Join(filepath.Dir(name), c.RootDir)
+	}
+
+	return c.ImportMap()
+}
+
+// ReadConfig reads and validates the config file, problems are reported as *ConfigError with the line
+// and column they occur at
+func ReadConfig(name string) (*Config, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(name, b)
+}
+
+// Write stores the config file on disk
+func (c *Config) Write(name string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, append(b, '\n'), os.FileMode(0644))
+}
+
+// Get returns the package with the given name and scope, or nil when it is not configured
+func (c *Config) Get(name, scope string) *PackageConfig {
+	for i := range c.Packages {
+		if c.Packages[i].Name == name && c.Packages[i].Scope == scope {
+			return &c.Packages[i]
+		}
+	}
+
+	return nil
+}
+
+// Set adds the package or replaces the one with the same name and scope, packages are kept sorted
+func (c *Config) Set(p PackageConfig) {
+	if existing := c.Get(p.Name, p.Scope); existing != nil {
+		*existing = p
+		return
+	}
+
+	c.Packages = append(c.Packages, p)
+	sort.SliceStable(c.Packages, func(i, j int) bool {
+		if c.Packages[i].Name != c.Packages[j].Name {
+			return c.Packages[i].Name < c.Packages[j].Name
+		}
+		return c.Packages[i].Scope < c.Packages[j].Scope
+	})
+}
+
+// Remove removes the package with the given name and scope, it reports whether the package was configured
+func (c *Config) Remove(name, scope string) bool {
+	for i, p := range c.Packages {
+		if p.Name == name && p.Scope == scope {
+			c.Packages = append(c.Packages[:i], c.Packages[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// ImportMap returns an ImportMap configured with the defaults, the settings and the packages of the config
+func (c *Config) ImportMap() (*ImportMap, error) {
+	im := New().WithDefaults()
+
+	if c.Provider != "" {
+		p, err := NewProvider(c.Provider, "")
+		if err != nil {
+			return nil, err
+		}
+		im.WithProvider(p)
+	}
+
+	if c.RootDir != "" {
+		im.RootDir(c.RootDir)
+	}
+	if c.AssetsDir != "" {
+		im.AssetsDir(c.AssetsDir)
+	}
+	if c.CacheDir != "" {
+		im.CacheDir(c.CacheDir)
+	}
+	if c.LockFile != "" {
+		im.LockFile(c.LockFile)
+	}
+	if c.Shim != "" {
+		im.ShimPath(c.Shim)
+	}
+	if c.Integrity != "" {
+		im.WithIntegrity(library.HashAlgorithm(c.Integrity))
+	}
+
+	im.WithDependencies(c.Dependencies)
+	im.Fingerprint(c.Fingerprint)
+
+	if c.Retries > 0 {
+		im.WithRetry(library.Retry{MaxAttempts: c.Retries + 1})
+	}
+
+	if c.MetadataCache != "" {
+		ttl, err := time.ParseDuration(c.MetadataCache)
+		if err != nil {
+			return nil, err
+		}
+		im.WithMetadataCache(ttl)
+	}
+
+	for name, selectors := range c.Entrypoints {
+		im.WithEntrypoint(name, selectors...)
+	}
+
+	for _, pc := range c.Packages {
+		pkg, err := pc.Package()
+		if err != nil {
+			return nil, err
+		}
+		im.WithPackage(pkg)
+	}
+
+	return im, nil
+}
+
+// Package returns the library package described by the config
+func (pc PackageConfig) Package() (library.Package, error) {
+	pkg := library.Package{
+		Name:    pc.Name,
+		Version: pc.Version,
+		Scope:   pc.Scope,
+	}
+
+	if pc.Provider != "" {
+		p, err := NewProvider(pc.Provider, pc.URL)
+		if err != nil {
+			return pkg, fmt.Errorf("package %s: %w", pc.Name, err)
+		}
+		pkg.Provider = p
+	}
+
+	for _, ic := range pc.Require {
+		pkg.Require = append(pkg.Require, library.Include{File: ic.File, Raw: ic.Raw, As: ic.As, Order: ic.Order})
+	}
+
+	return pkg, nil
+}
@@ -0,0 +1,287 @@
+package importmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+// ConfigError describes a problem in the config file, Line and Column are 1-based and zero when unknown
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configSource keeps the content of the config file and the offset of every value, keyed by its path
+// like packages[1].require[0].file, so validation errors can point at the offending line
+type configSource struct {
+	name    string
+	data    []byte
+	offsets map[string]int64
+}
+
+func parseConfig(name string, data []byte) (*Config, error) {
+	src := &configSource{name: name, data: data, offsets: make(map[string]int64)}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err := src.index(dec, "", reflect.TypeOf(Config{}))
+	if err != nil {
+		return nil, src.decodeError(err)
+	}
+
+	if _, err = dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, src.errorAt(dec.InputOffset(), errors.New("unexpected content after the config"))
+	}
+
+	var c Config
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, src.decodeError(err)
+	}
+
+	if err = src.validate(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// index walks the tokens of the value at path, it records the offset of every value and rejects fields
+// that do not exist in typ
+func (src *configSource) index(dec *json.Decoder, path string, typ reflect.Type) error {
+	start := src.skip(dec.InputOffset())
+	src.offsets[path] = start
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		fields := jsonFields(typ)
+		for dec.More() {
+			keyStart := src.skip(dec.InputOffset())
+
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			field, known := fields[key.(string)]
+			if typ != nil && typ.Kind() == reflect.Struct && !known {
+				return src.errorAt(keyStart, fmt.Errorf("unknown field %q", key))
+			}
+
+			err = src.index(dec, join(path, key.(string)), field)
+			if err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		var elem reflect.Type
+		if typ != nil && typ.Kind() == reflect.Slice {
+			elem = typ.Elem()
+		}
+
+		for i := 0; dec.More(); i++ {
+			err = src.index(dec, fmt.Sprintf("%s[%d]", path, i), elem)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+
+	// the closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// jsonFields returns the json names of the fields of a struct type
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return fields
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		if name == "" {
+			name = typ.Field(i).Name
+		}
+		fields[name] = typ.Field(i).Type
+	}
+
+	return fields
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// skip returns the offset of the next value, skipping whitespace and separators
+func (src *configSource) skip(offset int64) int64 {
+	for offset < int64(len(src.data)) && strings.IndexByte(" \t\r\n,:", src.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (src *configSource) errorAt(offset int64, err error) *ConfigError {
+	line, col := 1, 1
+	for _, b := range src.data[:min(offset, int64(len(src.data)))] {
+		if b == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+
+	return &ConfigError{File: src.name, Line: line, Column: col, Err: err}
+}
+
+// errorAtPath reports the error at the value of the path, falling back to the file when it is not found
+func (src *configSource) errorAtPath(path string, err error) *ConfigError {
+	if offset, ok := src.offsets[path]; ok {
+		return src.errorAt(offset, err)
+	}
+
+	return &ConfigError{File: src.name, Err: err}
+}
+
+// decodeError positions the errors of encoding/json
+func (src *configSource) decodeError(err error) error {
+	var (
+		syntax  *json.SyntaxError
+		typeErr *json.UnmarshalTypeError
+		cfgErr  *ConfigError
+	)
+
+	switch {
+	case errors.As(err, &cfgErr):
+		return cfgErr
+	case errors.As(err, &syntax):
+		return src.errorAt(syntax.Offset, errors.New(strings.TrimPrefix(syntax.Error(), "json: ")))
+	case errors.As(err, &typeErr):
+		if offset, ok := src.offsets[typeErr.Field]; ok {
+			return src.errorAt(offset, fmt.Errorf("%s must be a %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value))
+		}
+		if typeErr.Field != "" {
+			return src.errorAt(typeErr.Offset, fmt.Errorf("%s must be a %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value))
+		}
+		return src.errorAt(typeErr.Offset, fmt.Errorf("expected a %s, got %s", typeErr.Type, typeErr.Value))
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return src.errorAt(int64(len(src.data)), errors.New("unexpected end of the config"))
+	}
+
+	return &ConfigError{File: src.name, Err: err}
+}
+
+// validate checks the values of the config, all problems are returned joined together
+func (src *configSource) validate(c *Config) error {
+	var errs []error
+
+	if c.Provider != "" && !knownProvider(c.Provider) {
+		errs = append(errs, src.errorAtPath("provider", fmt.Errorf("unknown provider %q", c.Provider)))
+	}
+	if c.Provider == "raw" {
+		errs = append(errs, src.errorAtPath("provider", errors.New("the raw provider can only be set on a package")))
+	}
+
+	switch library.HashAlgorithm(c.Integrity) {
+	case "", library.SHA256, library.SHA384, library.SHA512:
+	default:
+		errs = append(errs, src.errorAtPath("integrity", fmt.Errorf("unsupported integrity %q, use sha256, sha384 or sha512", c.Integrity)))
+	}
+
+	if c.Retries < 0 {
+		errs = append(errs, src.errorAtPath("retries", fmt.Errorf("retries must not be negative, got %d", c.Retries)))
+	}
+
+	if c.MetadataCache != "" {
+		if ttl, err := time.ParseDuration(c.MetadataCache); err != nil || ttl < 0 {
+			errs = append(errs, src.errorAtPath("metadataCache", fmt.Errorf("invalid duration %q, use e.g. 1h or 0s", c.MetadataCache)))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Entrypoints)) {
+		if name == "" {
+			errs = append(errs, src.errorAtPath("entrypoints", errors.New("entrypoint without name")))
+		} else if len(c.Entrypoints[name]) == 0 {
+			errs = append(errs, src.errorAtPath("entrypoints."+name, fmt.Errorf("entrypoint %q selects nothing", name)))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, p := range c.Packages {
+		at := fmt.Sprintf("packages[%d]", i)
+
+		if p.Name == "" {
+			errs = append(errs, src.errorAtPath(at, errors.New("package without name")))
+		} else if seen[p.Scope+" "+p.Name] {
+			errs = append(errs, src.errorAtPath(at+".name", fmt.Errorf("package %s is configured twice", p.Name)))
+		}
+		seen[p.Scope+" "+p.Name] = true
+
+		switch {
+		case p.Provider != "" && !knownProvider(p.Provider):
+			errs = append(errs, src.errorAtPath(at+".provider", fmt.Errorf("unknown provider %q", p.Provider)))
+		case p.Provider == "raw" && p.URL == "":
+			errs = append(errs, src.errorAtPath(at+".provider", errors.New("the raw provider requires a url")))
+		case p.Provider != "raw" && p.URL != "":
+			errs = append(errs, src.errorAtPath(at+".url", errors.New("url is only used by the raw provider")))
+		}
+
+		if p.Scope != "" && !strings.HasPrefix(p.Scope, "/") && !strings.Contains(p.Scope, "://") {
+			errs = append(errs, src.errorAtPath(at+".scope", fmt.Errorf("scope %q must be an absolute path or URL", p.Scope)))
+		}
+
+		for j, r := range p.Require {
+			rat := fmt.Sprintf("%s.require[%d]", at, j)
+
+			switch {
+			case r.File == "" && r.Raw == "":
+				errs = append(errs, src.errorAtPath(rat, errors.New("require needs a file or a raw url")))
+			case r.File != "" && r.Raw != "":
+				errs = append(errs, src.errorAtPath(rat+".raw", errors.New("require has both a file and a raw url")))
+			case r.Raw != "" && r.As == "":
+				errs = append(errs, src.errorAtPath(rat+".raw", errors.New("a raw require needs an alias in as")))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func knownProvider(name string) bool {
+	_, err := NewProvider(name, "-")
+	return err == nil
+}
@@ -0,0 +1,157 @@
+package importmap
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+// fetchDependencies walks the dependency tree of the fetched packages level by level. A dependency is
+// added to the top level imports the first time it is seen, a later conflicting version is mapped
+// within the scope of the package that requires it.
+func (im *ImportMap) fetchDependencies(ctx context.Context, run *fetchRun, roots []fetched) []error {
+	versions := make(map[string]string)
+	for _, r := range roots {
+		if r.pkg.Scope == "" {
+			versions[r.pkg.Name] = r.pkg.Version
+		}
+	}
+
+	var (
+		visited = make(map[string]bool)
+		level   = roots
+		errs    []error
+	)
+
+	for len(level) > 0 {
+		deps := make([][]library.Dependency, len(level))
+		for i, err := range run.packages.forEach(len(level), func(i int) error {
+			resolver, ok := level[i].provider.(library.DependencyResolver)
+			if !ok {
+				return nil
+			}
+
+			var err error
+			deps[i], err = resolver.FetchDependencies(ctx, level[i].pkg.Name, level[i].pkg.Version)
+			return err
+		}) {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("resolving dependencies of %s@%s: %w", level[i].pkg.Name, level[i].pkg.Version, err))
+			}
+		}
+
+		var next []library.Package
+		for i, parent := range level {
+			for _, dep := range deps[i] {
+				// a dependency without an ES module, like a types-only package, has nothing to import
+				if dep.Entry == "" {
+					if im.logger != nil {
+						im.logger.WarnContext(ctx, "skipping dependency without module entry", "package", dep.Name, "version", dep.Version, "parent", parent.pkg.Name)
+					}
+					continue
+				}
+
+				im.require(parent.pkg.Name, dep.Name)
+
+				// remember the dependency so CacheOrFetch and offline fetches know the package requires it
+				if lp := run.lock.Get(parent.pkg.Name, parent.pkg.Scope); lp != nil && !slices.Contains(lp.Dependencies, dep.Name) {
+					lp.Dependencies = append(lp.Dependencies, dep.Name)
+				}
+
+				pkg := library.Package{
+					Name:     dep.Name,
+					Version:  dep.Version,
+					Provider: parent.provider,
+					Require:  library.Includes{{File: dep.Entry, As: dep.Name}},
+				}
+
+				if v, ok := versions[dep.Name]; !ok {
+					versions[dep.Name] = dep.Version
+				} else if v != dep.Version {
+					pkg.Scope = parent.prefix
+				}
+
+				key := pkg.Scope + " " + pkg.Name + "@" + pkg.Version
+				if visited[key] || (pkg.Scope == "" && im.hasPackage(dep.Name)) {
+					continue
+				}
+				visited[key] = true
+
+				if im.logger != nil {
+					im.logger.InfoContext(ctx, "adding dependency", "package", dep.Name, "version", dep.Version, "parent", parent.pkg.Name, "scope", pkg.Scope)
+				}
+
+				next = append(next, pkg)
+			}
+		}
+
+		var failed []error
+		level, failed = im.fetchPackages(ctx, run, next)
+		errs = append(errs, failed...)
+
+		// remember the entry so the dependency can be rebuilt from the lockfile in offline mode
+		for _, r := range level {
+			if lp := run.lock.Get(r.pkg.Name, r.pkg.Scope); lp != nil {
+				lp.Entry = r.pkg.Require[0].File
+			}
+
+			err := im.addPackageDir(ctx, r.pkg, r.prefix)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("package %s: %w", r.pkg.Name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// addPackageDir maps the name of a dependency followed by a slash to its package dir, so deep imports
+// like dep/sub resolve. A vendored package gets the other modules of its cache next to its entry.
+func (im *ImportMap) addPackageDir(ctx context.Context, pkg library.Package, prefix string) error {
+	if im.assetsDir != nil && im.cacheDir != nil && !im.offline && pkg.HasCache(im.store(), *im.cacheDir) {
+		files, err := pkg.CachedFiles(im.store(), *im.cacheDir)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if file.Type != library.FileTypeJS ||
+				(pkg.HasAssetFile(im.store(), *im.assetsDir, file.LocalPath) && !im.assetOutdated(pkg, *im.cacheDir, true, file.LocalPath)) {
+				continue
+			}
+
+			err = pkg.MakeAssets(ctx, im.client(), im.store(), *im.cacheDir, *im.assetsDir, file.LocalPath, file.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	im.addImport(pkg.Scope, pkg.Name+"/", prefix)
+	return nil
+}
+
+// hasPackage reports whether the package is explicitly configured at the top level
+func (im *ImportMap) hasPackage(name string) bool {
+	for _, p := range im.packages {
+		if p.Name == name && p.Scope == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// require records that the package imports the dependency, so entrypoints selecting the package include it
+func (im *ImportMap) require(name, dependency string) {
+	if slices.Contains(im.requires[name], dependency) {
+		return
+	}
+
+	if im.requires == nil {
+		im.requires = make(map[string][]string)
+	}
+	im.requires[name] = append(im.requires[name], dependency)
+}
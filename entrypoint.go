@@ -0,0 +1,170 @@
+package importmap
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+// WithEntrypoint defines a named entrypoint, like "admin" or "public", that renders only part of the import
+// map, see RenderOptions.Entrypoint. A selector is either a specifier of the imports or the styles, or the
+// name of a top level package selecting all of its specifiers. The rendered import map holds the selected
+// imports and everything they need: the imports of local modules, static and dynamic, the dependencies
+// resolved for their packages and the scopes of the modules. Defining an entrypoint again replaces it.
+func (im *ImportMap) WithEntrypoint(name string, selectors ...string) *ImportMap {
+	if im.entrypoints == nil {
+		im.entrypoints = make(map[string][]string)
+	}
+
+	im.entrypoints[name] = selectors
+	return im
+}
+
+// own records the specifier of a top level package, so entrypoints can select the package by its name
+func (im *ImportMap) own(pkg library.Package, specifier string, fileType library.FileType) {
+	if pkg.Scope != "" {
+		return
+	}
+
+	if im.owned == nil {
+		im.owned = make(map[string]owned)
+	}
+
+	o := im.owned[pkg.Name]
+	switch fileType {
+	case library.FileTypeJS:
+		if !slices.Contains(o.imports, specifier) {
+			o.imports = append(o.imports, specifier)
+		}
+	case library.FileTypeCSS:
+		if !slices.Contains(o.styles, specifier) {
+			o.styles = append(o.styles, specifier)
+		}
+	}
+	im.owned[pkg.Name] = o
+}
+
+// owner returns the name of the top level package the import specifier belongs to
+func (im *ImportMap) owner(specifier string) (string, bool) {
+	for name, o := range im.owned {
+		if slices.Contains(o.imports, specifier) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// entrypoint returns the part of the structure the entrypoint needs, the whole structure for an empty name
+func (im *ImportMap) entrypoint(name string) (structure, error) {
+	if name == "" {
+		return im.Structure, nil
+	}
+
+	selectors, ok := im.entrypoints[name]
+	if !ok {
+		return structure{}, fmt.Errorf("entrypoint: unknown entrypoint %q", name)
+	}
+
+	s := structure{
+		Imports:   make(map[string]string),
+		Scopes:    make(map[string]map[string]string),
+		Styles:    make(map[string]string),
+		Integrity: im.Structure.Integrity,
+	}
+
+	var (
+		queue []string
+		seen  = make(map[string]bool)
+	)
+
+	visit := func(u string) {
+		if !seen[u] {
+			seen[u] = true
+			queue = append(queue, u)
+		}
+	}
+
+	var addImport func(key string)
+	addImport = func(key string) {
+		if _, ok := s.Imports[key]; ok {
+			return
+		}
+
+		s.Imports[key] = im.Structure.Imports[key]
+		visit(im.Structure.Imports[key])
+
+		// the imports of remote modules can not be read, the resolved dependencies of the package stand in
+		if pkg, ok := im.owner(key); ok {
+			for _, dep := range im.requires[pkg] {
+				// the package dir of the dependency is taken along for its deep imports
+				for _, key := range []string{dep, dep + "/"} {
+					if _, ok := im.Structure.Imports[key]; ok {
+						addImport(key)
+					}
+				}
+			}
+		}
+	}
+
+	for _, selector := range selectors {
+		found := false
+
+		if _, ok := im.Structure.Imports[selector]; ok {
+			addImport(selector)
+			found = true
+		}
+
+		if u, ok := im.Structure.Styles[selector]; ok {
+			s.Styles[selector] = u
+			found = true
+		}
+
+		if o, ok := im.owned[selector]; ok {
+			for _, specifier := range o.imports {
+				addImport(specifier)
+			}
+			for _, specifier := range o.styles {
+				s.Styles[specifier] = im.Structure.Styles[specifier]
+			}
+			found = true
+		}
+
+		if !found {
+			return structure{}, fmt.Errorf("entrypoint %q: unknown specifier or package %q", name, selector)
+		}
+	}
+
+	for len(queue) > 0 {
+		referrer := queue[0]
+		queue = queue[1:]
+
+		// a scope applies to every module below its prefix, its mappings are taken over as a whole
+		for prefix, scope := range im.Structure.Scopes {
+			if _, ok := s.Scopes[prefix]; !ok && strings.HasPrefix(referrer, prefix) {
+				s.Scopes[prefix] = scope
+				for _, u := range scope {
+					visit(u)
+				}
+			}
+		}
+
+		imports := im.moduleImports(referrer)
+		for _, specifier := range slices.Concat(imports.static, imports.dynamic) {
+			if !bare(specifier) {
+				if u, ok := im.Structure.resolve(specifier, referrer); ok {
+					visit(u)
+				}
+				continue
+			}
+
+			if scope, key, ok := im.Structure.lookup(specifier, referrer); ok && scope == "" {
+				addImport(key)
+			}
+		}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,112 @@
+package importmap
+
+import (
+	"fmt"
+	"html/template"
+	"slices"
+)
+
+// FuncMap returns template functions rendering the parts of the import map, so layouts can place them
+// individually:
+//
+//	importmap [nonce|options]                   the import map script tag
+//	importmapStyles [nonce|options]             the stylesheet links
+//	importmapShim [nonce|options]               the script tag of the ES module shim
+//	importmapPreload [options] specifier...     modulepreload links of the entrypoints and their static imports
+//	importmapPath specifier                     the url of a module or stylesheet, escaped by the template like any string
+//
+// The options are a RenderOptions value, e.g. from the template data, so a page can pass its nonce and its
+// entrypoint, see WithEntrypoint. The specifiers of importmapPreload are added to the Preload of the options.
+// The functions read the ImportMap when the template executes, so a Fetch after parsing is picked up.
+func (im *ImportMap) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"importmap": func(args ...any) (template.HTML, error) {
+			opts, err := nonceOptions(args)
+			if err != nil {
+				return "", err
+			}
+			return im.RenderImportMap(opts)
+		},
+		"importmapStyles": func(args ...any) (template.HTML, error) {
+			opts, err := nonceOptions(args)
+			if err != nil {
+				return "", err
+			}
+			return im.RenderStyles(opts)
+		},
+		"importmapShim": func(args ...any) (template.HTML, error) {
+			opts, err := nonceOptions(args)
+			if err != nil {
+				return "", err
+			}
+			return im.RenderShim(opts), nil
+		},
+		"importmapPreload": func(args ...any) (template.HTML, error) {
+			opts, specifiers, err := funcOptions(args)
+			if err != nil {
+				return "", err
+			}
+			opts.Preload = append(slices.Clip(opts.Preload), specifiers...)
+			return im.RenderPreloads(opts)
+		},
+		"importmapPath": im.Path,
+	}
+}
+
+// Path returns the url the specifier is mapped to, stylesheets are looked up by their specifier as well
+func (im *ImportMap) Path(specifier string) (string, error) {
+	if u, ok := im.Structure.Imports[specifier]; ok {
+		return u, nil
+	}
+
+	if u, ok := im.Structure.Styles[specifier]; ok {
+		return u, nil
+	}
+
+	return "", fmt.Errorf("importmap: unknown specifier %q", specifier)
+}
+
+// funcOptions splits the arguments of a template function into the render options given as the first
+// argument, if any, and the strings that follow
+func funcOptions(args []any) (RenderOptions, []string, error) {
+	var opts RenderOptions
+	if len(args) > 0 {
+		switch o := args[0].(type) {
+		case RenderOptions:
+			opts, args = o, args[1:]
+		case *RenderOptions:
+			if o != nil {
+				opts = *o
+			}
+			args = args[1:]
+		}
+	}
+
+	strs := make([]string, 0, len(args))
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return RenderOptions{}, nil, fmt.Errorf("importmap: unexpected template argument of type %T", arg)
+		}
+		strs = append(strs, s)
+	}
+
+	return opts, strs, nil
+}
+
+// nonceOptions returns the render options of a template function taking either options or a nonce
+func nonceOptions(args []any) (RenderOptions, error) {
+	opts, strs, err := funcOptions(args)
+	if err != nil {
+		return RenderOptions{}, err
+	}
+
+	switch {
+	case len(args) > 1:
+		return RenderOptions{}, fmt.Errorf("importmap: expected a nonce or options, got %d arguments", len(args))
+	case len(strs) == 1:
+		opts.Nonce = strs[0]
+	}
+
+	return opts, nil
+}
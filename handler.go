@@ -0,0 +1,257 @@
+package importmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+// content types of the modules and stylesheets
+const (
+	javascriptType = "text/javascript; charset=utf-8"
+	cssType        = "text/css; charset=utf-8"
+)
+
+// precompressed lists the encodings that are served from a precompressed variant next to the file, in order of preference
+var precompressed = []struct {
+	encoding  string
+	extension string
+}{
+	{encoding: "br", extension: ".br"},
+	{encoding: "gzip", extension: ".gz"},
+}
+
+type (
+	// assetHandler serves the local files of an import map, see Handler
+	assetHandler struct {
+		store library.Storage
+		local map[string]string // content types of the local files by url path
+		dirs  []string          // url paths of the local package dirs mapped for deep imports
+		etags sync.Map          // etags by etagKey, so a revalidation does not read the file
+	}
+
+	// etagKey identifies a version of a served file
+	etagKey struct {
+		name    string
+		modTime time.Time
+		size    int64
+	}
+)
+
+// Handler returns an http.Handler that serves the local files recorded in the Structure, any other
+// path results in a 404. Modules are served as javascript and stylesheets as css, regardless of their file
+// extension. Source maps are served next to the files they belong to, the modules of a dependency below
+// the package dir it maps for deep imports. Precompressed
+// .br and .gz variants are preferred when the client accepts them. The files are those recorded when
+// Handler is called, so call it after Fetch or CacheOrFetch.
+//
+// Mount it on the path the assets are served from, e.g. http.Handle("/assets/", im.Handler())
+func (im *ImportMap) Handler() http.Handler {
+	local, dirs := im.localPaths()
+	return &assetHandler{store: im.store(), local: local, dirs: dirs}
+}
+
+func (h *assetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := path.Clean(r.URL.Path)
+	ct, ok := h.serves(urlPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(urlPath, "/")
+
+	header := w.Header()
+	header.Set("Content-Type", ct)
+	header.Add("Vary", "Accept-Encoding")
+
+	if library.IsFingerprinted(strings.TrimSuffix(urlPath, ".map")) {
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		header.Set("Cache-Control", "no-cache")
+	}
+
+	file, encoding, err := openAsset(h.store, name, r.Header.Get("Accept-Encoding"))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// files of an fs.FS are not required to be seekable, those are read into memory
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	etag, err := h.etag(etagKey{name: name + encoding, modTime: stat.ModTime(), size: stat.Size()}, content)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("ETag", etag)
+
+	// ServeContent handles If-None-Match, HEAD and range requests
+	http.ServeContent(w, r, urlPath, stat.ModTime(), content)
+}
+
+// etag returns the etag of the content, it is hashed once per name, modification time and size
+func (h *assetHandler) etag(key etagKey, content io.ReadSeeker) (string, error) {
+	if etag, ok := h.etags.Load(key); ok {
+		return etag.(string), nil
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	etag := `"` + hex.EncodeToString(sum.Sum(nil))[:32] + `"`
+	h.etags.Store(key, etag)
+
+	return etag, nil
+}
+
+// serves returns the content type of the path when it is a local file of the import map, or the source map of one
+func (h *assetHandler) serves(urlPath string) (string, bool) {
+	if ct, ok := h.local[urlPath]; ok {
+		return ct, true
+	}
+
+	if _, ok := h.local[strings.TrimSuffix(urlPath, ".map")]; ok && strings.HasSuffix(urlPath, ".map") {
+		return contentType(urlPath), true
+	}
+
+	for _, dir := range h.dirs {
+		if strings.HasPrefix(urlPath, dir) {
+			if ct := contentType(urlPath); ct != "application/octet-stream" {
+				return ct, true
+			}
+			return javascriptType, true
+		}
+	}
+
+	return "", false
+}
+
+// localPaths returns the content types of the local files recorded in the structure by url path, and the
+// local package dirs. The type follows from where the url is used, raw packages are vendored without a
+// file extension.
+func (im *ImportMap) localPaths() (map[string]string, []string) {
+	var (
+		local = make(map[string]string)
+		dirs  []string
+	)
+
+	add := func(url string, ct string) {
+		switch {
+		case !strings.HasPrefix(url, "/") || strings.HasPrefix(url, "//"):
+		case strings.HasSuffix(url, "/") && ct == javascriptType:
+			dirs = append(dirs, path.Clean(url)+"/")
+		default:
+			local[path.Clean(url)] = ct
+		}
+	}
+
+	for _, v := range im.Structure.Imports {
+		add(v, javascriptType)
+	}
+	for _, scope := range im.Structure.Scopes {
+		for _, v := range scope {
+			add(v, javascriptType)
+		}
+	}
+	for _, v := range im.Structure.Styles {
+		add(v, cssType)
+	}
+
+	return local, dirs
+}
+
+// openAsset opens the best precompressed variant the client accepts, falling back to the file itself
+func openAsset(fsys fs.FS, name string, acceptEncoding string) (fs.File, string, error) {
+	for _, pc := range precompressed {
+		if !acceptsEncoding(acceptEncoding, pc.encoding) {
+			continue
+		}
+
+		file, err := fsys.Open(name + pc.extension)
+		if err == nil {
+			return file, pc.encoding, nil
+		}
+	}
+
+	file, err := fsys.Open(name)
+	return file, "", err
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows the encoding
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+
+	return false
+}
+
+// contentType returns the content type of a file that is not part of the structure by its extension
+func contentType(urlPath string) string {
+	switch path.Ext(urlPath) {
+	case ".js", ".mjs":
+		return javascriptType
+	case ".css":
+		return cssType
+	case ".map", ".json":
+		return "application/json"
+	}
+
+	if ct := mime.TypeByExtension(path.Ext(urlPath)); ct != "" {
+		return ct
+	}
+
+	return "application/octet-stream"
+}
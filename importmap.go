@@ -1,14 +1,21 @@
 package importmap
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"log/slog"
-	"os"
+	"net/http"
 	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/donseba/go-importmap/client/cdnjs"
 	"github.com/donseba/go-importmap/library"
@@ -20,6 +27,9 @@ var (
 	defaultShimSrc   = "https://ga.jspm.io/npm:es-module-shims@2.0.10/dist/es-module-shims.js"
 )
 
+// metadataDir is the dir in the cache dir holding the provider metadata, npm package names can not start with a dot
+const metadataDir = ".metadata"
+
 type (
 	ImportMap struct {
 		provider  library.Provider  // the js library provider
@@ -27,17 +37,92 @@ type (
 		Structure structure         // the output structure
 
 		rootDir   string
+		storage   library.Storage
 		assetsDir *string
 		cacheDir  *string
+		lockFile  *string
+		integrity library.HashAlgorithm
+
+		dependencies bool
+		concurrency  int
+		httpClient   *http.Client
+		retry        *library.Retry
+		metadataTTL  *time.Duration
+		offline      bool
+		fingerprint  bool
 
 		shim   string
 		logger *slog.Logger
+
+		graph       sync.Map                      // imports of the local modules by url, see moduleImports
+		styleRanks  map[string]styleRank          // position of the stylesheets by specifier, see sortedStyles
+		entrypoints map[string][]string           // selectors by entrypoint name, see WithEntrypoint
+		owned       map[string]owned              // top level specifiers by package name
+		requires    map[string][]string           // names of the resolved dependencies by package name
+		wrapped     map[*http.Client]*http.Client // clients handed to the providers and the client they wrap
+	}
+
+	// RenderOptions configures the html of RenderWith
+	RenderOptions struct {
+		// Preload lists the specifiers the page imports eagerly, they are emitted as modulepreload links
+		// together with every module they import statically, so the browser fetches them in parallel
+		Preload []string
+		// PreloadStyles emits a preload link for every stylesheet ahead of the stylesheet links
+		PreloadStyles bool
+		// Nonce is added to every script and link tag to satisfy a Content-Security-Policy with a per-request nonce
+		Nonce string
+		// Entrypoint restricts the import map and the stylesheets to the entrypoint of the page, see WithEntrypoint
+		Entrypoint string
 	}
 
 	structure struct {
-		Imports map[string]string            `json:"imports,omitempty"`
-		Scopes  map[string]map[string]string `json:"scopes,omitempty"`
-		Styles  map[string]string            `json:"styles,omitempty"`
+		Imports   map[string]string            `json:"imports,omitempty"`
+		Scopes    map[string]map[string]string `json:"scopes,omitempty"`
+		Styles    map[string]string            `json:"styles,omitempty"`
+		Integrity map[string]string            `json:"integrity,omitempty"`
+	}
+
+	// fetched is a package as it was resolved by Fetch, it is applied to the structure once all
+	// packages of a batch are done so the output does not depend on download order
+	fetched struct {
+		pkg       library.Package
+		provider  library.Provider
+		prefix    string // URL prefix of the package files
+		imports   []entry
+		styles    []style
+		integrity map[string]string
+		locked    *LockedPackage
+	}
+
+	entry struct {
+		specifier string
+		url       string
+	}
+
+	style struct {
+		entry
+		rank styleRank
+	}
+
+	// owned are the top level specifiers of a package, see WithEntrypoint
+	owned struct {
+		imports []string
+		styles  []string
+	}
+
+	// styleRank orders the stylesheets by the Order of their include, then by package and Require order
+	styleRank struct {
+		order   int
+		pkg     int
+		require int
+		file    int
+	}
+
+	// importMap is the browser facing import map
+	importMap struct {
+		Imports   map[string]string            `json:"imports"`
+		Scopes    map[string]map[string]string `json:"scopes,omitempty"`
+		Integrity map[string]string            `json:"integrity,omitempty"`
 	}
 )
 
@@ -45,9 +130,10 @@ type (
 func New() *ImportMap {
 	return &ImportMap{
 		Structure: structure{
-			Imports: make(map[string]string),
-			Scopes:  make(map[string]map[string]string),
-			Styles:  make(map[string]string),
+			Imports:   make(map[string]string),
+			Scopes:    make(map[string]map[string]string),
+			Styles:    make(map[string]string),
+			Integrity: make(map[string]string),
 		},
 	}
 }
@@ -60,6 +146,7 @@ func (im *ImportMap) WithDefaults() *ImportMap {
 	im.CacheDir(defaultCacheDir)
 	im.AssetsDir(defaultAssetsDir)
 	im.ShimPath(defaultShimSrc)
+	im.LockFile(defaultLockFile)
 	im.WithProvider(cdnjs.New())
 	return im
 }
@@ -95,8 +182,8 @@ func (im *ImportMap) Clean() *ImportMap {
 		assetsDir = *im.assetsDir
 	}
 
-	_ = os.RemoveAll(path.Join(im.rootDir, cacheDir))
-	_ = os.RemoveAll(path.Join(im.rootDir, assetsDir))
+	_ = im.store().RemoveAll(cacheDir)
+	_ = im.store().RemoveAll(assetsDir)
 	return im
 }
 
@@ -110,11 +197,111 @@ func (im *ImportMap) AssetsDir(dir string) *ImportMap {
 	return im
 }
 
+// LockFile sets the path of the lockfile, relative to the root dir. The lockfile records the resolved
+// version, provider and file hashes of every package so later fetches do not drift.
+func (im *ImportMap) LockFile(file string) *ImportMap {
+	im.lockFile = &file
+	return im
+}
+
+// WithIntegrity enables subresource integrity, the digests are computed from the cached files
+// with the given algorithm and emitted on stylesheet links and in the import map.
+func (im *ImportMap) WithIntegrity(algo library.HashAlgorithm) *ImportMap {
+	im.integrity = algo
+	return im
+}
+
+// WithDependencies enables resolving the transitive dependencies of packages whose provider implements
+// library.DependencyResolver, they are added to the imports or to a scope when their versions conflict.
+func (im *ImportMap) WithDependencies(enabled bool) *ImportMap {
+	im.dependencies = enabled
+	return im
+}
+
+// WithConcurrency sets how many packages, and how many files per package, are fetched at the same time
+func (im *ImportMap) WithConcurrency(n int) *ImportMap {
+	im.concurrency = n
+	return im
+}
+
+// WithHTTPClient sets the http client used to download files. The client is also handed to every
+// provider that implements library.HTTPClientSetter, replacing the client it was constructed with.
+// Without it, the providers keep their own client, see WithRetry.
+func (im *ImportMap) WithHTTPClient(c *http.Client) *ImportMap {
+	im.httpClient = c
+	return im
+}
+
+// WithRetry retries provider requests and downloads that failed with a network error, a 429 or a 5xx
+// response, see library.Retry. It wraps the transport of the client set with WithHTTPClient, or of
+// http.DefaultClient. Providers that implement library.HTTPClientGetter keep the client they were
+// constructed with, wrapped with the retries, unless WithHTTPClient replaces it.
+func (im *ImportMap) WithRetry(r library.Retry) *ImportMap {
+	im.retry = &r
+	return im
+}
+
+// WithMetadataCache stores the metadata responses of the providers in the cache dir, see
+// library.MetadataCache. Responses younger than ttl are reused without a request, older ones are
+// revalidated with their ETag or Last-Modified date. A ttl of 0 always revalidates.
+func (im *ImportMap) WithMetadataCache(ttl time.Duration) *ImportMap {
+	im.metadataTTL = &ttl
+	return im
+}
+
+// client returns the http client used for providers and downloads, nil when none was configured
+func (im *ImportMap) client() *http.Client {
+	if im.retry != nil {
+		return im.retry.Client(im.httpClient)
+	}
+
+	return im.httpClient
+}
+
+// Offline builds the structure purely from the cache and the lockfile without touching the network.
+// Packages or files that are not available locally are reported with a *MissingError.
+func (im *ImportMap) Offline(enabled bool) *ImportMap {
+	im.offline = enabled
+	return im
+}
+
+// Fingerprint writes assets with a hash of their content in the file name, e.g. htmx.min.3f9a1c2b.js,
+// so they can be served with a long-lived immutable cache policy. Previous fingerprints are removed.
+// Only the mapped files know their new name, references between the files of a package, like a relative
+// import of ./chunk.js, url() in a stylesheet or a sourceMappingURL, no longer resolve. Use it for
+// packages whose files stand on their own, like bundled builds.
+func (im *ImportMap) Fingerprint(enabled bool) *ImportMap {
+	im.fingerprint = enabled
+	return im
+}
+
 func (im *ImportMap) RootDir(dir string) *ImportMap {
 	im.rootDir = dir
 	return im
 }
 
+// WithStorage sets the storage that holds the cache, the assets and the lockfile, replacing the root dir
+func (im *ImportMap) WithStorage(st library.Storage) *ImportMap {
+	im.storage = st
+	return im
+}
+
+// WithFS reads the cache, the assets and the lockfile from fsys, e.g. an embed.FS. Nothing can be written,
+// so it is meant to be combined with Offline(true).
+func (im *ImportMap) WithFS(fsys fs.FS) *ImportMap {
+	im.storage = library.ReadOnly(fsys)
+	return im
+}
+
+// store returns the configured storage, defaulting to the root dir on disk
+func (im *ImportMap) store() library.Storage {
+	if im.storage != nil {
+		return im.storage
+	}
+
+	return library.DirStorage(im.rootDir)
+}
+
 func (im *ImportMap) Shim() string {
 	return im.shim
 }
@@ -125,6 +312,8 @@ func (im *ImportMap) ShimPath(sp string) *ImportMap {
 }
 
 func (im *ImportMap) CacheOrFetch(ctx context.Context) error {
+	im.graph.Clear()
+
 	if im.logger != nil {
 		im.logger.InfoContext(ctx, "checking cache and assets for packages")
 	}
@@ -133,13 +322,34 @@ func (im *ImportMap) CacheOrFetch(ctx context.Context) error {
 		return errors.New("cacheDir and assetsDir must be set")
 	}
 
-	for _, pkg := range im.packages {
+	if im.offline {
+		return im.Fetch(ctx)
+	}
+
+	lock, err := im.readLock()
+	if err != nil {
+		return err
+	}
+
+	// the transitive dependencies are known from the lockfile of the last fetch
+	packages := im.packages
+	if im.dependencies {
+		packages = append(slices.Clip(packages), im.lockedDependencies(lock)...)
+	}
+
+	for n, pkg := range packages {
 		if im.logger != nil {
 			im.logger.InfoContext(ctx, "checking package cache and assets", "package", pkg.Name)
 		}
 
-		cacheExists := pkg.HasCache(im.rootDir, *im.cacheDir)
-		assetsExist := pkg.HasAssets(im.rootDir, *im.assetsDir)
+		// use the locked version so the cache lookup does not fall back to "latest" or a range
+		locked := lock.Get(pkg.Name, pkg.Scope)
+		if locked != nil && locked.Satisfies(pkg.Version) {
+			pkg.Version = locked.Version
+		}
+
+		cacheExists := pkg.HasCache(im.store(), *im.cacheDir)
+		assetsExist := pkg.HasAssets(im.store(), *im.assetsDir)
 
 		if !cacheExists {
 			if im.logger != nil {
@@ -153,12 +363,13 @@ func (im *ImportMap) CacheOrFetch(ctx context.Context) error {
 			continue
 		}
 
-		if !assetsExist {
-			if im.logger != nil {
+		// fingerprinted assets carry their content in the name, plain ones may still hold another version
+		if !assetsExist || !im.fingerprint {
+			if !assetsExist && im.logger != nil {
 				im.logger.InfoContext(ctx, "assets not found, building from cache", "package", pkg.Name)
 			}
 			// Build assets from cache
-			allFiles, _, err := pkg.Assets(*im.cacheDir, "")
+			allFiles, err := pkg.CachedFiles(im.store(), *im.cacheDir)
 			if err != nil {
 				if im.logger != nil {
 					im.logger.ErrorContext(ctx, "error reading cache for assets", "package", pkg.Name, "error", err)
@@ -166,8 +377,17 @@ func (im *ImportMap) CacheOrFetch(ctx context.Context) error {
 				return err
 			}
 			for _, file := range allFiles {
-				if !pkg.HasAssetFile(im.rootDir, *im.assetsDir, file.LocalPath) {
-					err = pkg.MakeAssets(im.rootDir, *im.cacheDir, *im.assetsDir, file.LocalPath, file.Path)
+				if im.fingerprint {
+					_, err = pkg.MakeFingerprintedAssets(ctx, im.client(), im.store(), *im.cacheDir, *im.assetsDir, file.LocalPath, file.Path)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				exists := pkg.HasAssetFile(im.store(), *im.assetsDir, file.LocalPath)
+				if (!assetsExist && !exists) || (exists && im.assetOutdated(pkg, *im.cacheDir, true, file.LocalPath)) {
+					err = pkg.MakeAssets(ctx, im.client(), im.store(), *im.cacheDir, *im.assetsDir, file.LocalPath, file.Path)
 					if err != nil {
 						return err
 					}
@@ -176,138 +396,681 @@ func (im *ImportMap) CacheOrFetch(ctx context.Context) error {
 		}
 
 		// Always update Structure.Imports with asset paths
-		allFiles, _, err := pkg.Assets(*im.assetsDir, "")
+		allFiles, _, err := pkg.Assets(im.store(), *im.assetsDir, "")
 		if err != nil {
 			if im.logger != nil {
 				im.logger.ErrorContext(ctx, "error reading assets", "package", pkg.Name, "error", err)
 			}
 			return err
 		}
-		for _, file := range allFiles {
+		for i, file := range allFiles {
+			localPath := file.LocalPath
+			if im.fingerprint {
+				if !library.IsFingerprinted(localPath) {
+					continue
+				}
+				localPath = library.StripFingerprint(localPath)
+			}
+
+			rank := styleRank{pkg: im.packageIndex(pkg), require: -1, file: i}
+
 			var as string
 			if len(pkg.Require) > 0 {
-				req := pkg.Require.Get(file.LocalPath)
-				if req == nil {
+				rank.require = pkg.Require.Index(localPath)
+				if rank.require < 0 {
 					continue
 				}
-				as = req.Name()
+				as, rank.order = pkg.Require[rank.require].Name(), pkg.Require[rank.require].Order
 			} else {
-				as = file.LocalPath
+				as = localPath
 			}
 
-			switch file.Type {
+			// raw files are named after their package, the locked url tells their type
+			ft := file.Type
+			if ft == library.FileTypeOther && locked != nil {
+				if lf := locked.File(localPath); lf != nil {
+					ft = fileType(library.File{LocalPath: localPath, Path: lf.URL})
+				}
+			}
+
+			switch ft {
 			case library.FileTypeCSS:
-				im.Structure.Styles[as] = file.Path
+				im.addStyle(as, file.Path, rank)
 			case library.FileTypeJS:
-				im.Structure.Imports[as] = file.Path
+				im.addImport(pkg.Scope, as, file.Path)
+			default:
+				continue
+			}
+			im.own(pkg, as, ft)
+
+			err = im.addIntegrity(pkg, localPath, file.LocalPath, file.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the locked dependencies follow the configured packages
+		if n >= len(im.packages) {
+			err = im.addPackageDir(ctx, pkg, im.packagePrefix(pkg, nil))
+			if err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
+// Fetch resolves all packages through their provider and builds the cache and assets. Packages and
+// their files are fetched concurrently, see WithConcurrency. A failing package does not stop the
+// others, all errors are returned joined together.
 func (im *ImportMap) Fetch(ctx context.Context) error {
+	im.graph.Clear()
+
+	lock, err := im.readLock()
+	if err != nil {
+		return err
+	}
+
+	im.configureProviders()
+
+	run := newFetchRun(lock, im.concurrency)
+
+	results, errs := im.fetchPackages(ctx, run, im.packages)
+	if im.dependencies {
+		if im.offline {
+			deps, failed := im.fetchPackages(ctx, run, im.lockedDependencies(lock))
+			errs = append(errs, failed...)
+
+			for _, d := range deps {
+				err = im.addPackageDir(ctx, d.pkg, d.prefix)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		} else {
+			errs = append(errs, im.fetchDependencies(ctx, run, results)...)
+		}
+	}
+
+	if len(run.missing.Packages) > 0 {
+		errs = append(errs, &run.missing)
+	}
+
+	if im.offline {
+		return errors.Join(errs...)
+	}
+
+	if len(errs) == 0 {
+		// forget packages that are no longer part of the import map
+		lock.Retain(func(lp LockedPackage) bool {
+			return run.touched[lp.Scope+" "+lp.Name]
+		})
+	}
+
+	err = im.writeLock(lock)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// configureProviders hands the http client to all providers, this is done before fetching as the
+// providers are shared between concurrently fetched packages
+func (im *ImportMap) configureProviders() {
+	if im.httpClient == nil && im.retry == nil && im.metadataTTL == nil {
+		return
+	}
+
+	providers := []library.Provider{im.provider}
 	for _, pkg := range im.packages {
-		if im.logger != nil {
-			im.logger.InfoContext(ctx, "fetching assets", "package", pkg.Name)
+		providers = append(providers, pkg.Provider)
+	}
+
+	for _, p := range providers {
+		s, ok := p.(library.HTTPClientSetter)
+		if !ok {
+			continue
 		}
 
-		var provider library.Provider
-		if pkg.Provider != nil {
-			provider = pkg.Provider
-		} else {
-			provider = im.provider
+		base := im.httpClient
+		if g, ok := p.(library.HTTPClientGetter); ok && base == nil {
+			base = g.HTTPClient()
+			// a client handed out before is unwrapped first, so a provider shared by several packages
+			// or fetched again is not wrapped twice
+			if original, ok := im.wrapped[base]; ok {
+				delete(im.wrapped, base)
+				base = original
+			}
+		}
+
+		client := im.providerClient(base)
+		if im.wrapped == nil {
+			im.wrapped = make(map[*http.Client]*http.Client)
+		}
+		im.wrapped[client] = base
+
+		s.SetHTTPClient(client)
+	}
+}
+
+// providerClient wraps the client of a provider with the retries and the metadata cache
+func (im *ImportMap) providerClient(c *http.Client) *http.Client {
+	if im.retry != nil {
+		c = im.retry.Client(c)
+	}
+
+	if im.metadataTTL != nil && im.cacheDir != nil {
+		c = library.MetadataCache{
+			Storage: im.store(),
+			Dir:     path.Join(*im.cacheDir, metadataDir),
+			TTL:     *im.metadataTTL,
+		}.Client(c)
+	}
+
+	return c
+}
+
+// fetchPackages fetches the packages concurrently and applies the successful ones in the given order
+func (im *ImportMap) fetchPackages(ctx context.Context, run *fetchRun, packages []library.Package) ([]fetched, []error) {
+	results := make([]fetched, len(packages))
+	errs := run.packages.forEach(len(packages), func(i int) error {
+		var err error
+		results[i], err = im.fetchPackage(ctx, run, packages[i])
+		return err
+	})
+
+	var (
+		out    = make([]fetched, 0, len(packages))
+		failed []error
+	)
+
+	for i, err := range errs {
+		var missing *MissingError
+		if errors.As(err, &missing) {
+			run.missing.Packages = append(run.missing.Packages, missing.Packages...)
+			continue
 		}
 
-		allFiles, version, err := provider.FetchPackageFiles(ctx, pkg.Name, pkg.Version)
 		if err != nil {
-			return err
+			failed = append(failed, fmt.Errorf("package %s: %w", packages[i].Name, err))
+			continue
+		}
+
+		im.apply(results[i], run)
+		out = append(out, results[i])
+	}
+
+	return out, failed
+}
+
+func (im *ImportMap) fetchPackage(ctx context.Context, run *fetchRun, pkg library.Package) (fetched, error) {
+	if im.logger != nil {
+		im.logger.InfoContext(ctx, "fetching assets", "package", pkg.Name)
+	}
+
+	var provider library.Provider
+	if pkg.Provider != nil {
+		provider = pkg.Provider
+	} else {
+		provider = im.provider
+	}
+
+	var (
+		allFiles  library.Files
+		version   string
+		requested = pkg.Version
+		err       error
+	)
+
+	locked := run.lock.Get(pkg.Name, pkg.Scope)
+	if locked != nil && !im.offline && (locked.Provider != library.ProviderName(provider) || !satisfies(pkg.Version, locked.Version)) {
+		// the package changed since it was locked or asks for a dist-tag, resolve it again
+		locked = nil
+	}
+
+	if im.offline && (locked == nil || !locked.Satisfies(pkg.Version)) {
+		return fetched{}, &MissingError{Packages: []MissingPackage{{Name: pkg.Name, Version: pkg.Version, Scope: pkg.Scope}}}
+	}
+
+	if locked != nil {
+		allFiles, version = locked.LibraryFiles(), locked.Version
+	} else {
+		allFiles, version, err = provider.FetchPackageFiles(ctx, pkg.Name, pkg.Version)
+		if err != nil {
+			return fetched{}, err
 		}
+	}
+
+	// the resolved version replaces a range or tag, it names the cache dir and is recorded in the lock
+	if version != "" {
+		pkg.Version = version
+	}
 
-		if pkg.Version == "" {
-			pkg.Version = version
+	res := fetched{
+		pkg:       pkg,
+		provider:  provider,
+		prefix:    im.packagePrefix(pkg, allFiles),
+		integrity: make(map[string]string),
+	}
+
+	var cacheDir string
+	if im.cacheDir != nil {
+		cacheDir = *im.cacheDir
+	}
+
+	if cacheDir != "" && !im.offline && !pkg.HasCache(im.store(), cacheDir) {
+		if im.logger != nil {
+			im.logger.InfoContext(ctx, "building cache", "package", pkg.Name, "version", pkg.Version)
 		}
 
-		if im.cacheDir != nil && !pkg.HasCache(im.rootDir, *im.cacheDir) {
-			if im.logger != nil {
-				im.logger.InfoContext(ctx, "building cache", "package", pkg.Name, "version", pkg.Version)
-			}
+		err = errors.Join(run.files.forEach(len(allFiles), func(i int) error {
+			return pkg.MakeCache(ctx, im.client(), im.store(), cacheDir, allFiles[i].LocalPath, allFiles[i].Path)
+		})...)
+		if err != nil {
+			// a partial cache dir would be taken as complete by the next run
+			_ = im.store().RemoveAll(pkg.CacheDir(cacheDir))
+			return fetched{}, err
+		}
+	}
 
-			for _, file := range allFiles {
-				err = pkg.MakeCache(im.rootDir, *im.cacheDir, file.LocalPath, file.Path)
-				if err != nil {
-					return err
-				}
+	if run.lock != nil && !im.offline {
+		lp, err := im.lockPackage(pkg, provider, allFiles, locked)
+		if err != nil {
+			if locked != nil && cacheDir != "" {
+				// never keep content that does not match the lockfile around
+				_ = im.store().RemoveAll(pkg.CacheDir(cacheDir))
 			}
+			return fetched{}, err
 		}
 
-		var cacheDir string
-		if im.cacheDir != nil {
-			cacheDir = *im.cacheDir
+		lp.Requested = requested
+		res.locked = &lp
+	}
+
+	if im.logger != nil {
+		im.logger.InfoContext(ctx, "building assets", "package", pkg.Name, "version", pkg.Version)
+	}
+
+	type requiredFile struct {
+		library.File
+		as   string
+		rank styleRank
+	}
+
+	var required []requiredFile
+	for i, file := range allFiles {
+		rank := styleRank{pkg: im.packageIndex(pkg), require: -1, file: i}
+
+		var as string
+		if len(pkg.Require) > 0 {
+			rank.require = pkg.Require.Index(file.LocalPath)
+			if rank.require < 0 {
+				continue
+			}
+
+			req := pkg.Require[rank.require]
+			as, rank.order = req.Name(), req.Order
+		} else {
+			as = file.LocalPath
 		}
 
-		if im.logger != nil {
-			im.logger.InfoContext(ctx, "building assets", "package", pkg.Name, "version", pkg.Version)
+		required = append(required, requiredFile{File: file, as: as, rank: rank})
+	}
+
+	if im.offline && im.assetsDir != nil {
+		files := make(library.Files, 0, len(required))
+		for _, file := range required {
+			files = append(files, file.File)
 		}
 
-		assetFiles := make(library.Includes, 0)
+		if missing := im.missingFiles(pkg, files); len(missing) > 0 {
+			return fetched{}, &MissingError{Packages: []MissingPackage{{Name: pkg.Name, Version: pkg.Version, Scope: pkg.Scope, Files: missing}}}
+		}
+	}
 
-		for _, file := range allFiles {
-			var as string
-			if len(pkg.Require) > 0 {
-				req := pkg.Require.Get(file.LocalPath)
-				if req == nil {
-					continue
+	assetPaths := make([]string, len(required))
+	if im.assetsDir != nil {
+		err = errors.Join(run.files.forEach(len(required), func(i int) error {
+			file := required[i]
+			if im.fingerprint {
+				if im.offline && !pkg.HasCacheFile(im.store(), cacheDir, file.LocalPath) {
+					assetPaths[i], _ = pkg.FingerprintedAsset(im.store(), *im.assetsDir, file.LocalPath)
+					return nil
 				}
 
-				as = req.Name()
-			} else {
-				as = file.LocalPath
+				var err error
+				assetPaths[i], err = pkg.MakeFingerprintedAssets(ctx, im.client(), im.store(), cacheDir, *im.assetsDir, file.LocalPath, file.Path)
+				return err
 			}
 
-			if im.assetsDir != nil {
-				if !pkg.HasAssetFile(im.rootDir, *im.assetsDir, file.LocalPath) {
-					err = pkg.MakeAssets(im.rootDir, cacheDir, *im.assetsDir, file.LocalPath, file.Path)
-					if err != nil {
-						return err
-					}
-				}
-
-				assetFiles = append(assetFiles, library.Include{
-					File: path.Join(im.rootDir, pkg.AssetsDir(*im.assetsDir), file.LocalPath),
-					As:   as,
-				})
-			} else {
-				assetFiles = append(assetFiles, library.Include{
-					File: file.Path,
-					As:   as,
-				})
+			assetPaths[i] = file.LocalPath
+			if pkg.HasAssetFile(im.store(), *im.assetsDir, file.LocalPath) && !im.assetOutdated(pkg, cacheDir, locked != nil, file.LocalPath) {
+				return nil
 			}
+			return pkg.MakeAssets(ctx, im.client(), im.store(), cacheDir, *im.assetsDir, file.LocalPath, file.Path)
+		})...)
+		if err != nil {
+			return fetched{}, err
 		}
+	}
 
-		for _, file := range assetFiles {
-			// check if it starts with a /, if not, add it
-			if file.File[0] != '/' && file.File[0] != 'h' {
-				file.File = "/" + file.File
+	for i, file := range required {
+		url := file.Path
+		if im.assetsDir != nil {
+			url = path.Join(pkg.AssetsDir(*im.assetsDir), assetPaths[i])
+		}
 
-			}
+		// check if it starts with a /, if not, add it
+		if url[0] != '/' && url[0] != 'h' {
+			url = "/" + url
+		}
 
-			switch library.ExtractFileType(file.File) {
-			case library.FileTypeCSS:
-				im.Structure.Styles[file.As] = file.File
-			case library.FileTypeJS:
-				im.Structure.Imports[file.As] = file.File
+		switch fileType(file.File) {
+		case library.FileTypeCSS:
+			res.styles = append(res.styles, style{entry: entry{specifier: file.as, url: url}, rank: file.rank})
+		case library.FileTypeJS:
+			res.imports = append(res.imports, entry{specifier: file.as, url: url})
+		default:
+			continue
+		}
+
+		integrity, err := im.fileIntegrity(pkg, file.LocalPath, assetPaths[i])
+		if err != nil {
+			return fetched{}, err
+		}
+		if integrity != "" {
+			res.integrity[url] = integrity
+		}
+	}
+
+	for _, req := range pkg.Require {
+		if req.Raw != "" {
+			res.imports = append(res.imports, entry{specifier: req.Name(), url: req.Raw})
+		}
+	}
+
+	return res, nil
+}
+
+// assetOutdated reports whether an existing asset of the file was built from other content than the package
+// version now serves, e.g. by the previous version. The asset is compared with the cached file, without it
+// only an asset of a package that was not resolved again is trusted. Offline nothing can be rewritten.
+func (im *ImportMap) assetOutdated(pkg library.Package, cacheDir string, locked bool, filePath string) bool {
+	if im.offline {
+		return false
+	}
+
+	if cacheDir != "" && pkg.HasCacheFile(im.store(), cacheDir, filePath) {
+		return !sameContent(im.store(), path.Join(pkg.CacheDir(cacheDir), filePath), path.Join(pkg.AssetsDir(*im.assetsDir), filePath))
+	}
+
+	return !locked
+}
+
+// sameContent reports whether both files exist and have the same content
+func sameContent(fsys fs.FS, a, b string) bool {
+	a, b = strings.TrimPrefix(a, "/"), strings.TrimPrefix(b, "/")
+
+	sa, errA := fs.Stat(fsys, a)
+	sb, errB := fs.Stat(fsys, b)
+	if errA != nil || errB != nil || sa.Size() != sb.Size() {
+		return false
+	}
+
+	ca, errA := fs.ReadFile(fsys, a)
+	cb, errB := fs.ReadFile(fsys, b)
+
+	return errA == nil && errB == nil && bytes.Equal(ca, cb)
+}
+
+// satisfies reports whether the locked version fulfils the requested version, which is empty, an exact
+// version or a range. Dist-tags are never satisfied as they move.
+func satisfies(requested, locked string) bool {
+	if requested == "" || requested == locked {
+		return true
+	}
+
+	r, err := library.ParseRange(requested)
+	if err != nil {
+		return false
+	}
+
+	v, err := library.ParseVersion(locked)
+	return err == nil && r.Match(v)
+}
+
+// fileType returns the type of the file, raw files are named after their package so then the type comes from the URL
+func fileType(f library.File) library.FileType {
+	if t := library.ExtractFileType(f.LocalPath); t != library.FileTypeOther {
+		return t
+	}
+
+	return library.ExtractFileType(f.Path)
+}
+
+// apply merges a fetched package into the structure and the lock
+func (im *ImportMap) apply(res fetched, run *fetchRun) {
+	for _, e := range res.imports {
+		im.addImport(res.pkg.Scope, e.specifier, e.url)
+		im.own(res.pkg, e.specifier, library.FileTypeJS)
+	}
+
+	for _, e := range res.styles {
+		im.addStyle(e.specifier, e.url, e.rank)
+		im.own(res.pkg, e.specifier, library.FileTypeCSS)
+	}
+
+	for url, integrity := range res.integrity {
+		if im.Structure.Integrity == nil {
+			im.Structure.Integrity = make(map[string]string)
+		}
+		im.Structure.Integrity[url] = integrity
+	}
+
+	if run.lock != nil && res.locked != nil {
+		run.lock.Set(*res.locked)
+		run.touched[res.locked.Scope+" "+res.locked.Name] = true
+	}
+}
+
+// packagePrefix returns the URL prefix all files of the package are served from
+func (im *ImportMap) packagePrefix(pkg library.Package, files library.Files) string {
+	if im.assetsDir != nil {
+		return "/" + strings.TrimPrefix(pkg.AssetsDir(*im.assetsDir), "/") + "/"
+	}
+
+	var prefix string
+	for i, file := range files {
+		dir := file.Path[:strings.LastIndex(file.Path, "/")+1]
+		if i == 0 || strings.HasPrefix(prefix, dir) {
+			prefix = dir
+			continue
+		}
+
+		for !strings.HasPrefix(dir, prefix) {
+			prefix = prefix[:strings.LastIndex(strings.TrimSuffix(prefix, "/"), "/")+1]
+		}
+	}
+
+	return prefix
+}
+
+// addStyle adds the stylesheet, the rank decides its position in the rendered html
+func (im *ImportMap) addStyle(specifier, url string, rank styleRank) {
+	im.Structure.Styles[specifier] = url
+
+	if im.styleRanks == nil {
+		im.styleRanks = make(map[string]styleRank)
+	}
+	im.styleRanks[specifier] = rank
+}
+
+// sortedStyles returns the stylesheets in the order they are rendered, see library.Include.Order.
+// Stylesheets added to the Structure directly come last, sorted by specifier.
+func (im *ImportMap) sortedStyles(s structure) []entry {
+	styles := make([]entry, 0, len(s.Styles))
+	for specifier, url := range s.Styles {
+		styles = append(styles, entry{specifier: specifier, url: url})
+	}
+
+	sort.Slice(styles, func(i, j int) bool {
+		a, aRanked := im.styleRanks[styles[i].specifier]
+		b, bRanked := im.styleRanks[styles[j].specifier]
+
+		switch {
+		case aRanked != bRanked:
+			return aRanked
+		case !aRanked:
+			return styles[i].specifier < styles[j].specifier
+		case a.order != b.order:
+			return a.order < b.order
+		case a.pkg != b.pkg:
+			return a.pkg < b.pkg
+		case a.require != b.require:
+			return a.require < b.require
+		case a.file != b.file:
+			return a.file < b.file
+		}
+
+		return styles[i].specifier < styles[j].specifier
+	})
+
+	return styles
+}
+
+// packageIndex returns the position of the package in the configured packages, dependencies come last
+func (im *ImportMap) packageIndex(pkg library.Package) int {
+	for i, p := range im.packages {
+		if p.Name == pkg.Name && p.Scope == pkg.Scope {
+			return i
+		}
+	}
+
+	return len(im.packages)
+}
+
+// addImport maps the specifier to url, either top level or within the given scope
+func (im *ImportMap) addImport(scope, specifier, url string) {
+	if scope == "" {
+		im.Structure.Imports[specifier] = url
+		return
+	}
+
+	if im.Structure.Scopes == nil {
+		im.Structure.Scopes = make(map[string]map[string]string)
+	}
+	if im.Structure.Scopes[scope] == nil {
+		im.Structure.Scopes[scope] = make(map[string]string)
+	}
+
+	im.Structure.Scopes[scope][specifier] = url
+}
+
+// addIntegrity records the integrity of the file served at url
+func (im *ImportMap) addIntegrity(pkg library.Package, localPath string, assetPath string, url string) error {
+	integrity, err := im.fileIntegrity(pkg, localPath, assetPath)
+	if err != nil || integrity == "" {
+		return err
+	}
+
+	if im.Structure.Integrity == nil {
+		im.Structure.Integrity = make(map[string]string)
+	}
+	im.Structure.Integrity[url] = integrity
+
+	return nil
+}
+
+// fileIntegrity returns the integrity of a package file when integrity is enabled. The digest is computed
+// from the file that is served, the asset file, falling back to the cached file when there are no assets.
+func (im *ImportMap) fileIntegrity(pkg library.Package, localPath string, assetPath string) (string, error) {
+	if im.integrity == "" {
+		return "", nil
+	}
+
+	var candidates []string
+	if im.assetsDir != nil && *im.assetsDir != "" && assetPath != "" {
+		candidates = append(candidates, path.Join(pkg.AssetsDir(*im.assetsDir), assetPath))
+	}
+	if im.cacheDir != nil && *im.cacheDir != "" {
+		candidates = append(candidates, path.Join(pkg.CacheDir(*im.cacheDir), localPath))
+	}
+
+	for _, c := range candidates {
+		integrity, err := library.FSIntegrity(im.store(), c, im.integrity)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		return integrity, err
+	}
+
+	return "", nil
+}
+
+// lockPackage builds the lock entry of the package from its cached files. When the package was
+// already locked every cached file must match the recorded integrity.
+func (im *ImportMap) lockPackage(pkg library.Package, provider library.Provider, files library.Files, locked *LockedPackage) (LockedPackage, error) {
+	lp := LockedPackage{
+		Name:     pkg.Name,
+		Scope:    pkg.Scope,
+		Version:  pkg.Version,
+		Provider: library.ProviderName(provider),
+		Files:    make([]LockedFile, 0, len(files)),
+	}
+
+	for _, file := range files {
+		lf := LockedFile{
+			Path: file.LocalPath,
+			URL:  file.Path,
+		}
+
+		if im.cacheDir != nil && pkg.HasCache(im.store(), *im.cacheDir) {
+			integrity, err := library.FSIntegrity(im.store(), path.Join(pkg.CacheDir(*im.cacheDir), file.LocalPath), defaultLockAlgorithm)
+			if err != nil {
+				return lp, err
 			}
+			lf.Integrity = integrity
 		}
 
-		for _, req := range pkg.Require {
-			if req.Raw != "" {
-				im.Structure.Imports[req.Name()] = req.Raw
+		if locked != nil {
+			if want := locked.File(file.LocalPath); want != nil && want.Integrity != "" && lf.Integrity != "" && want.Integrity != lf.Integrity {
+				return lp, fmt.Errorf("content of %s@%s %s does not match the lockfile: want %s, got %s", pkg.Name, pkg.Version, file.LocalPath, want.Integrity, lf.Integrity)
 			}
 		}
+
+		lp.Files = append(lp.Files, lf)
 	}
 
-	return nil
+	return lp, nil
+}
+
+// readLock returns the lock from disk, or nil when no lockfile is configured
+func (im *ImportMap) readLock() (*Lock, error) {
+	if im.lockFile == nil || *im.lockFile == "" {
+		return nil, nil
+	}
+
+	return ReadLockFS(im.store(), *im.lockFile)
+}
+
+func (im *ImportMap) writeLock(lock *Lock) error {
+	if lock == nil || im.lockFile == nil || *im.lockFile == "" {
+		return nil
+	}
+
+	return lock.Store(im.store(), *im.lockFile)
+}
+
+// Lock returns the content of the lockfile, or nil when no lockfile is configured
+func (im *ImportMap) Lock() (*Lock, error) {
+	return im.readLock()
+}
+
+// SaveLock replaces the content of the lockfile, nothing is written when no lockfile is configured
+func (im *ImportMap) SaveLock(lock *Lock) error {
+	return im.writeLock(lock)
 }
 
 // Marshal returns the Structure as JSON.
@@ -320,15 +1083,59 @@ func (im *ImportMap) MarshalIndent() ([]byte, error) {
 	return json.MarshalIndent(im.Structure, "", "  ")
 }
 
-// Imports return the structure in JSON/HTML.
-func (im *ImportMap) Imports() (template.HTML, error) {
-	var in = struct {
-		Imports map[string]string `json:"imports"`
-	}{
-		Imports: im.Structure.Imports,
+// importMap returns the import map as the browser expects it
+func (s structure) importMap() importMap {
+	out := importMap{
+		Imports: s.Imports,
+	}
+
+	if len(s.Scopes) > 0 {
+		out.Scopes = s.Scopes
+	}
+
+	addIntegrity := func(url string) {
+		integrity, ok := s.Integrity[url]
+		if !ok {
+			return
+		}
+
+		if out.Integrity == nil {
+			out.Integrity = make(map[string]string)
+		}
+		out.Integrity[url] = integrity
+	}
+
+	for _, v := range s.Imports {
+		addIntegrity(v)
 	}
 
-	b, err := json.Marshal(in)
+	for _, scope := range s.Scopes {
+		for _, v := range scope {
+			addIntegrity(v)
+		}
+	}
+
+	return out
+}
+
+// linkAttributes returns the integrity attributes of a link to a stylesheet or module
+func (im *ImportMap) linkAttributes(href string) string {
+	integrity, ok := im.Structure.Integrity[href]
+	if !ok {
+		return ""
+	}
+
+	attrs := fmt.Sprintf(` integrity="%s"`, integrity)
+	if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "//") {
+		attrs += ` crossorigin="anonymous"`
+	}
+
+	return attrs
+}
+
+// Imports return the structure in JSON/HTML.
+func (im *ImportMap) Imports() (template.HTML, error) {
+	b, err := json.Marshal(im.Structure.importMap())
 	if err != nil {
 		return "", err
 	}
@@ -338,13 +1145,22 @@ func (im *ImportMap) Imports() (template.HTML, error) {
 
 // ImportsIndent return the structure in JSON/HTML.
 func (im *ImportMap) ImportsIndent() (template.HTML, error) {
-	var in = struct {
-		Imports map[string]string `json:"imports"`
-	}{
-		Imports: im.Structure.Imports,
+	b, err := json.MarshalIndent(im.Structure.importMap(), "", "  ")
+	if err != nil {
+		return "", err
 	}
 
-	b, err := json.MarshalIndent(in, "", "  ")
+	return template.HTML(b), nil
+}
+
+// ImportsFor returns the import map of the entrypoint in JSON, see WithEntrypoint
+func (im *ImportMap) ImportsFor(entrypoint string) (template.HTML, error) {
+	s, err := im.entrypoint(entrypoint)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(s.importMap())
 	if err != nil {
 		return "", err
 	}
@@ -367,8 +1183,8 @@ func (im *ImportMap) Styles() (template.HTML, error) {
 	}
 
 	var out string
-	for k, v := range im.Structure.Styles {
-		out += fmt.Sprintf(`<link rel="stylesheet" href="%s" as="%s">`, v, k)
+	for _, e := range im.sortedStyles(im.Structure) {
+		out += fmt.Sprintf(`<link rel="stylesheet" href="%s" as="%s"%s>`, escape(e.url), escape(e.specifier), im.linkAttributes(e.url))
 	}
 
 	return template.HTML(out), nil
@@ -376,37 +1192,120 @@ func (im *ImportMap) Styles() (template.HTML, error) {
 
 // Render returns an HTML snippet to use in a template
 func (im *ImportMap) Render() (template.HTML, error) {
-	var out template.HTML
+	return im.RenderWith(RenderOptions{})
+}
 
-	for k, v := range im.Structure.Styles {
-		out += template.HTML(fmt.Sprintf(`<link rel="stylesheet" href="%s" as="%s"/>
-`, v, k))
+// RenderWith returns an HTML snippet to use in a template, the options add preload hints and a nonce for
+// the page. It only reads the ImportMap, so it can be called for every request.
+func (im *ImportMap) RenderWith(opts RenderOptions) (template.HTML, error) {
+	importMap, err := im.RenderImportMap(opts)
+	if err != nil {
+		return "", err
 	}
 
-	if im.shim != "" {
-		out += template.HTML(fmt.Sprintf(`<script async src="%s"></script>
-`, im.shim))
+	// module preloads follow the import map, the browser ignores import maps added after a module load started
+	preloads, err := im.RenderPreloads(opts)
+	if err != nil {
+		return "", err
 	}
 
-	if len(im.Structure.Imports) > 0 {
-		out += `<script type="importmap">
-`
+	styles, err := im.RenderStyles(opts)
+	if err != nil {
+		return "", err
+	}
 
-		data := struct {
-			Imports map[string]string `json:"imports"`
-		}{
-			Imports: im.Structure.Imports,
+	var parts []string
+	for _, part := range []template.HTML{styles, im.RenderShim(opts), importMap, preloads} {
+		if part != "" {
+			parts = append(parts, string(part))
 		}
+	}
 
-		b, err := json.MarshalIndent(data, "", "  ")
-		if err != nil {
-			return "", err
+	return template.HTML(strings.Join(parts, "\n")), nil
+}
+
+// RenderStyles returns the stylesheet links, preceded by preload links when opts.PreloadStyles is set
+func (im *ImportMap) RenderStyles(opts RenderOptions) (template.HTML, error) {
+	s, err := im.entrypoint(opts.Entrypoint)
+	if err != nil {
+		return "", err
+	}
+
+	styles := im.sortedStyles(s)
+
+	var lines []string
+	if opts.PreloadStyles {
+		for _, e := range styles {
+			lines = append(lines, fmt.Sprintf(`<link rel="preload" href="%s" as="style"%s%s/>`, escape(e.url), im.linkAttributes(e.url), nonceAttribute(opts)))
 		}
+	}
+
+	for _, e := range styles {
+		lines = append(lines, fmt.Sprintf(`<link rel="stylesheet" href="%s" as="%s"%s%s/>`, escape(e.url), escape(e.specifier), im.linkAttributes(e.url), nonceAttribute(opts)))
+	}
+
+	return template.HTML(strings.Join(lines, "\n")), nil
+}
+
+// RenderShim returns the script tag of the ES module shim, empty when no shim is set
+func (im *ImportMap) RenderShim(opts RenderOptions) template.HTML {
+	if im.shim == "" {
+		return ""
+	}
+
+	return template.HTML(fmt.Sprintf(`<script async src="%s"%s></script>`, escape(im.shim), nonceAttribute(opts)))
+}
+
+// RenderImportMap returns the import map script tag, empty when nothing is mapped
+func (im *ImportMap) RenderImportMap(opts RenderOptions) (template.HTML, error) {
+	s, err := im.entrypoint(opts.Entrypoint)
+	if err != nil {
+		return "", err
+	}
+
+	if len(s.Imports) == 0 && len(s.Scopes) == 0 {
+		return "", nil
+	}
+
+	// json.Marshal escapes <, > and &, so the map can not close the script tag
+	b, err := json.MarshalIndent(s.importMap(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return template.HTML(fmt.Sprintf("<script type=\"importmap\"%s>\n%s\n</script>", nonceAttribute(opts), b)), nil
+}
+
+// RenderPreloads returns the modulepreload links of opts.Preload and every module they import statically
+func (im *ImportMap) RenderPreloads(opts RenderOptions) (template.HTML, error) {
+	s, err := im.entrypoint(opts.Entrypoint)
+	if err != nil {
+		return "", err
+	}
+
+	preloads, err := im.preloads(s, opts.Preload)
+	if err != nil {
+		return "", err
+	}
 
-		out += template.HTML(b)
-		out += `
-</script>`
+	var lines []string
+	for _, u := range preloads {
+		lines = append(lines, fmt.Sprintf(`<link rel="modulepreload" href="%s"%s%s/>`, escape(u), im.linkAttributes(u), nonceAttribute(opts)))
 	}
 
-	return out, nil
+	return template.HTML(strings.Join(lines, "\n")), nil
+}
+
+// nonceAttribute returns the nonce attribute of the options, empty without a nonce
+func nonceAttribute(opts RenderOptions) string {
+	if opts.Nonce == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(` nonce="%s"`, escape(opts.Nonce))
+}
+
+// escape escapes an attribute value
+func escape(s string) string {
+	return template.HTMLEscapeString(s)
 }
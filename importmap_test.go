@@ -1,10 +1,25 @@
 package importmap
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/donseba/go-importmap/client/cdnjs"
+	"github.com/donseba/go-importmap/client/esmsh"
 	"github.com/donseba/go-importmap/client/jsdelivr"
 	"github.com/donseba/go-importmap/client/raw"
 	"github.com/donseba/go-importmap/library"
@@ -246,3 +261,1861 @@ func TestImportRawClient(t *testing.T) {
 		return
 	}
 }
+
+type testProvider struct {
+	baseURL string
+	version string
+	files   []string
+}
+
+func (p *testProvider) FetchPackageFiles(_ context.Context, name, version string) (library.Files, string, error) {
+	if version == "" {
+		version = p.version
+	}
+
+	var files library.Files
+	for _, f := range p.files {
+		files = append(files, library.File{
+			Type:      library.ExtractFileType(f),
+			Path:      p.baseURL + "/" + name + "@" + version + "/" + f,
+			LocalPath: f,
+		})
+	}
+
+	return files, version, nil
+}
+
+func TestImportMapLockFile(t *testing.T) {
+	content := "console.log('v1')"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, content)
+	}))
+	defer srv.Close()
+
+	pr := &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.min.js"}}
+	root := t.TempDir()
+
+	newMap := func() *ImportMap {
+		return New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(pr).
+			WithPackage(library.Package{Name: "lib"})
+	}
+
+	err := newMap().Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lock, err := ReadLock(filepath.Join(root, defaultLockFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lp := lock.Get("lib", "")
+	if lp == nil || lp.Version != "1.0.0" || len(lp.Files) != 1 || lp.Files[0].Integrity == "" {
+		t.Errorf("unexpected lock entry %+v", lp)
+		return
+	}
+
+	// a new upstream release must not change the locked version
+	pr.version = "2.0.0"
+	im := newMap()
+	err = im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if im.Structure.Imports["lib.min.js"] != "/assets/lib/lib.min.js" {
+		t.Errorf("unexpected imports %v", im.Structure.Imports)
+	}
+
+	lock, err = ReadLock(filepath.Join(root, defaultLockFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if lock.Get("lib", "").Version != "1.0.0" {
+		t.Errorf("locked version drifted to %s", lock.Get("lib", "").Version)
+	}
+
+	// changed upstream content must fail loudly
+	content = "console.log('tampered')"
+	_ = os.RemoveAll(filepath.Join(root, defaultCacheDir))
+
+	err = newMap().Fetch(t.Context())
+	if err == nil {
+		t.Error("expected an integrity mismatch")
+	}
+}
+
+func TestImportMapIntegrity(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.min.js", "lib.min.css"}}
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(pr).
+		WithIntegrity(library.SHA384).
+		WithPackage(library.Package{Name: "lib"})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jsIntegrity, _ := library.Integrity(strings.NewReader("/lib@1.0.0/lib.min.js"), library.SHA384)
+	cssIntegrity, _ := library.Integrity(strings.NewReader("/lib@1.0.0/lib.min.css"), library.SHA384)
+
+	out, err := im.Render()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(string(out), `integrity="`+cssIntegrity+`"`) {
+		t.Errorf("missing stylesheet integrity in %s", out)
+	}
+
+	if !strings.Contains(string(out), `"integrity": {`) || !strings.Contains(string(out), `": "`+jsIntegrity+`"`) {
+		t.Errorf("missing import map integrity in %s", out)
+	}
+}
+
+func TestImportMapIntegrityVersionChange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	im := New().
+		WithDefaults().
+		RootDir(root).
+		WithProvider(&testProvider{baseURL: srv.URL, files: []string{"lib.js"}}).
+		WithIntegrity(library.SHA384)
+
+	for _, version := range []string{"1.0.0", "2.0.0"} {
+		im.WithPackages([]library.Package{{Name: "lib", Version: version}})
+
+		err := im.Fetch(t.Context())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// the integrity must match the file the browser receives
+		want, err := library.FileIntegrity(filepath.Join(root, "assets", "lib", "lib.js"), library.SHA384)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if got := im.Structure.Integrity["/assets/lib/lib.js"]; got != want {
+			t.Errorf("version %s: got integrity %s, want %s", version, got, want)
+		}
+	}
+}
+
+func TestImportMapScopes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testProvider{baseURL: srv.URL, version: "4.0.0", files: []string{"lodash.js"}}
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		ShimPath("").
+		WithProvider(pr).
+		WithPackages([]library.Package{
+			{
+				Name:    "lodash",
+				Require: library.Includes{{File: "lodash.js"}},
+			},
+			{
+				Name:    "lodash",
+				Version: "3.10.1",
+				Scope:   "/assets/legacy/",
+				Require: library.Includes{{File: "lodash.js"}},
+			},
+		})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	out, err := im.Imports()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := `{"imports":{"lodash":"/assets/lodash/lodash.js"},"scopes":{"/assets/legacy/":{"lodash":"/assets/lodash@3.10.1/lodash.js"}}}`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+type testResolverProvider struct {
+	testProvider
+	deps map[string][]library.Dependency
+}
+
+func (p *testResolverProvider) FetchDependencies(_ context.Context, name, version string) ([]library.Dependency, error) {
+	return p.deps[name+"@"+version], nil
+}
+
+func TestImportMapDependencies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testResolverProvider{
+		testProvider: testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"index.js"}},
+		deps: map[string][]library.Dependency{
+			"app@1.0.0":   {{Name: "hooks", Version: "2.0.0", Entry: "index.js"}, {Name: "core", Version: "10.0.0", Entry: "index.js"}},
+			"hooks@2.0.0": {{Name: "core", Version: "10.0.0", Entry: "index.js"}},
+			"core@10.0.0": {{Name: "util", Version: "1.2.3", Entry: "index.js"}},
+			"core@8.0.0":  {{Name: "util", Version: "1.2.3", Entry: "index.js"}},
+		},
+	}
+
+	im := New().
+		CacheDir(defaultCacheDir).
+		LockFile(defaultLockFile).
+		RootDir(t.TempDir()).
+		WithProvider(pr).
+		WithDependencies(true).
+		WithPackages([]library.Package{
+			{Name: "app", Require: library.Includes{{File: "index.js", As: "app"}}},
+			{Name: "core", Version: "8.0.0", Require: library.Includes{{File: "index.js", As: "core"}}},
+		})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	out, err := im.Imports()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// dependencies map their package dir as well, for deep imports like hooks/sub.js
+	want := `{"imports":{"app":"` + srv.URL + `/app@1.0.0/index.js","core":"` + srv.URL + `/core@8.0.0/index.js","hooks":"` + srv.URL + `/hooks@2.0.0/index.js","hooks/":"` + srv.URL + `/hooks@2.0.0/",` +
+		`"util":"` + srv.URL + `/util@1.2.3/index.js","util/":"` + srv.URL + `/util@1.2.3/"},` +
+		`"scopes":{"` + srv.URL + `/app@1.0.0/":{"core":"` + srv.URL + `/core@10.0.0/index.js","core/":"` + srv.URL + `/core@10.0.0/"},` +
+		`"` + srv.URL + `/hooks@2.0.0/":{"core":"` + srv.URL + `/core@10.0.0/index.js","core/":"` + srv.URL + `/core@10.0.0/"}}}`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestImportMapCacheOrFetchDependencies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testResolverProvider{
+		testProvider: testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"index.js", "sub.js"}},
+		deps: map[string][]library.Dependency{
+			"app@1.0.0": {{Name: "core", Version: "2.0.0", Entry: "index.js"}, {Name: "types-only", Version: "1.0.0"}},
+		},
+	}
+
+	root := t.TempDir()
+	newImportMap := func() *ImportMap {
+		return New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(pr).
+			WithDependencies(true).
+			WithPackage(library.Package{Name: "app", Require: library.Includes{{File: "index.js", As: "app"}}}).
+			WithEntrypoint("app", "app")
+	}
+
+	// the first start fetches, the second one finds everything in the cache
+	for _, run := range []string{"cold", "warm"} {
+		im := newImportMap()
+
+		err := im.CacheOrFetch(t.Context())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		out, err := im.ImportsFor("app")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		want := `{"imports":{"app":"/assets/app/index.js","core":"/assets/core/index.js","core/":"/assets/core/"}}`
+		if string(out) != want {
+			t.Errorf("%s: got %s, want %s", run, out, want)
+			return
+		}
+
+		// the other modules of a dependency are vendored and served for its deep imports
+		rec := httptest.NewRecorder()
+		im.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/core/sub.js", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "/core@2.0.0/sub.js" {
+			t.Errorf("%s: unexpected deep import response %d %q", run, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestImportMapEsmshDependencies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "@")
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/registry/"):
+			_, _ = io.WriteString(w, `{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{}}}`)
+		case r.URL.RawQuery == "meta":
+			_, _ = fmt.Fprintf(w, "/* esm.sh - %s@1.0.0 */\nexport * from \"/%s@1.0.0/es2022/%s.mjs\";\n", name, name, name)
+		case r.URL.Path == "/app@1.0.0/package.json":
+			_, _ = io.WriteString(w, `{"dependencies":{"core":"^1.0.0"}}`)
+		case strings.HasSuffix(r.URL.Path, "/package.json"):
+			_, _ = io.WriteString(w, `{}`)
+		default:
+			_, _ = io.WriteString(w, `export default {};`)
+		}
+	}))
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(esmsh.New(esmsh.WithAPIBase(srv.URL), esmsh.WithCDNBase(srv.URL), esmsh.WithRegistryBase(srv.URL+"/registry"))).
+		WithDependencies(true).
+		WithPackage(library.Package{Name: "app", Require: library.Includes{{File: "**.mjs", As: "app"}}})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	out, err := im.Imports()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := `{"imports":{"app":"/assets/app/app@1.0.0/es2022/app.mjs","core":"/assets/core/core@1.0.0/es2022/core.mjs","core/":"/assets/core/"}}`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+type failingProvider struct{}
+
+func (failingProvider) FetchPackageFiles(context.Context, string, string) (library.Files, string, error) {
+	return nil, "", errors.New("provider unavailable")
+}
+
+func TestImportMapConcurrentFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"a.js", "b.js", "c.js", "d.css"}}
+
+	var packages []library.Package
+	for _, name := range []string{"one", "two", "three", "four", "five"} {
+		packages = append(packages, library.Package{Name: name, Require: library.Includes{{File: "**", As: name}}})
+	}
+	packages = append(packages, library.Package{Name: "broken", Provider: failingProvider{}})
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(pr).
+		WithConcurrency(3).
+		WithPackages(packages)
+
+	err := im.Fetch(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "package broken: provider unavailable") {
+		t.Errorf("expected the broken package to fail, got %v", err)
+	}
+
+	if len(im.Structure.Imports) != 5 || len(im.Structure.Styles) != 5 {
+		t.Errorf("expected the other packages to be fetched, got %v %v", im.Structure.Imports, im.Structure.Styles)
+	}
+
+	// the last matching file of a package wins, regardless of download order
+	if !strings.HasSuffix(im.Structure.Imports["one"], "/assets/one/c.js") {
+		t.Errorf("unexpected import %s", im.Structure.Imports["one"])
+	}
+}
+
+func TestImportMapOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+
+	pr := &testResolverProvider{
+		testProvider: testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"index.js", "style.css"}},
+		deps: map[string][]library.Dependency{
+			"app@1.0.0": {{Name: "core", Version: "2.0.0", Entry: "index.js"}},
+		},
+	}
+
+	root := t.TempDir()
+	newMap := func(packages ...library.Package) *ImportMap {
+		return New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(pr).
+			WithDependencies(true).
+			WithPackages(append([]library.Package{{Name: "app", Require: library.Includes{{File: "index.js", As: "app"}}}}, packages...))
+	}
+
+	online := newMap()
+	err := online.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// from here on every request fails
+	srv.Close()
+
+	offline := newMap().Offline(true)
+	err = offline.CacheOrFetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want, _ := online.Imports()
+	got, _ := offline.Imports()
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	_ = os.RemoveAll(filepath.Join(root, defaultAssetsDir, "core"))
+	_ = os.Remove(filepath.Join(root, defaultCacheDir, "core", "2.0.0", "index.js"))
+
+	err = newMap(library.Package{Name: "extra"}).Offline(true).Fetch(t.Context())
+
+	var missing *MissingError
+	if !errors.As(err, &missing) {
+		t.Errorf("expected a MissingError, got %v", err)
+		return
+	}
+
+	if len(missing.Packages) != 2 ||
+		missing.Packages[0].Name != "extra" || len(missing.Packages[0].Files) != 0 ||
+		missing.Packages[1].Name != "core" || len(missing.Packages[1].Files) != 1 || missing.Packages[1].Files[0] != "index.js" {
+		t.Errorf("unexpected missing packages %+v", missing.Packages)
+	}
+}
+
+type testTagProvider struct {
+	testProvider
+	tags     map[string]string
+	versions []string
+	calls    atomic.Int32
+}
+
+func (p *testTagProvider) FetchVersions(context.Context, string) ([]string, error) {
+	return p.versions, nil
+}
+
+func (p *testTagProvider) FetchPackageFiles(ctx context.Context, name, version string) (library.Files, string, error) {
+	p.calls.Add(1)
+	if v, ok := p.tags[version]; ok {
+		version = v
+	}
+
+	return p.testProvider.FetchPackageFiles(ctx, name, version)
+}
+
+func TestImportMapDistTag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testTagProvider{
+		testProvider: testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.js"}},
+		tags:         map[string]string{"next": "2.0.0-beta.1"},
+		versions:     []string{"1.0.0", "2.0.0-beta.1", "2.0.0-beta.2"},
+	}
+
+	root := t.TempDir()
+	newMap := func() *ImportMap {
+		return New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(pr).
+			WithPackage(library.Package{Name: "lib", Version: "next"})
+	}
+
+	online := newMap()
+	err := online.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lock, err := ReadLock(filepath.Join(root, defaultLockFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if lp := lock.Get("lib", ""); lp == nil || lp.Version != "2.0.0-beta.1" || lp.Requested != "next" {
+		t.Errorf("expected lib@next locked to 2.0.0-beta.1, got %+v", lp)
+		return
+	}
+
+	// the tag is only resolved again by Fetch, the cache and offline mode use the locked version
+	pr.calls.Store(0)
+
+	cached := newMap()
+	err = cached.CacheOrFetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	offline := newMap().Offline(true)
+	err = offline.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if pr.calls.Load() != 0 {
+		t.Errorf("expected no provider requests, got %d", pr.calls.Load())
+	}
+
+	want, _ := online.Imports()
+	for _, im := range []*ImportMap{cached, offline} {
+		if got, _ := im.Imports(); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	// a moved tag is picked up by the next Fetch
+	pr.tags["next"] = "2.0.0-beta.2"
+
+	err = newMap().Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lock, err = ReadLock(filepath.Join(root, defaultLockFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if lp := lock.Get("lib", ""); lp == nil || lp.Version != "2.0.0-beta.2" {
+		t.Errorf("expected lib@next locked to 2.0.0-beta.2, got %+v", lp)
+		return
+	}
+
+	// the versions do not list tags, the locked version is reported instead
+	outdated, err := newMap().Outdated(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(outdated) != 1 || outdated[0].Requested != "next" || outdated[0].Current != "2.0.0-beta.2" || outdated[0].Major != "2.0.0-beta.2" {
+		t.Errorf("unexpected outdated packages %+v", outdated)
+	}
+}
+
+func TestImportMapFingerprint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.min.js"}}
+	root := t.TempDir()
+
+	fetch := func(version string) string {
+		im := New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(pr).
+			Fingerprint(true).
+			WithPackage(library.Package{Name: "lib", Version: version, Require: library.Includes{{File: "lib.min.js", As: "lib"}}})
+
+		err := im.Fetch(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return im.Structure.Imports["lib"]
+	}
+
+	first := fetch("1.0.0")
+	fingerprint := library.Fingerprint([]byte("/lib@1.0.0/lib.min.js"))
+	if !strings.HasSuffix(first, "/assets/lib/lib.min."+fingerprint+".js") {
+		t.Errorf("unexpected fingerprinted import %s", first)
+	}
+
+	second := fetch("2.0.0")
+	if second == first {
+		t.Error("fingerprint did not change on upgrade")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, defaultAssetsDir, "lib"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(entries) != 1 || "/"+entries[0].Name() != second[strings.LastIndex(second, "/"):] {
+		t.Errorf("expected only the new fingerprint to remain, got %v", entries)
+	}
+}
+
+func TestImportMapFingerprintRaw(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	newMap := func() *ImportMap {
+		return New().
+			WithDefaults().
+			RootDir(root).
+			Fingerprint(true).
+			WithPackage(library.Package{Name: "htmx", Provider: raw.New(srv.URL + "/htmx.min.js")})
+	}
+
+	// a fingerprint left behind by an earlier download of the package
+	err := os.MkdirAll(filepath.Join(root, defaultAssetsDir, "htmx"), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(root, defaultAssetsDir, "htmx", "htmx.0123abcd"), []byte("old"), 0644)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	im := newMap()
+	err = im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := "/assets/htmx/htmx." + library.Fingerprint([]byte("/htmx.min.js"))
+	if im.Structure.Imports["htmx"] != want {
+		t.Errorf("got import %s, want %s", im.Structure.Imports["htmx"], want)
+		return
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, defaultAssetsDir, "htmx"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(entries) != 1 || "/assets/htmx/"+entries[0].Name() != want {
+		t.Errorf("expected only the new fingerprint to remain, got %v", entries)
+	}
+
+	cached := newMap()
+	err = cached.CacheOrFetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	offline := newMap().Offline(true)
+	err = offline.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, im := range []*ImportMap{cached, offline} {
+		if im.Structure.Imports["htmx"] != want {
+			t.Errorf("got import %s, want %s", im.Structure.Imports["htmx"], want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	im.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, want, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("expected an immutable response, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestImportMapHandler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.min.js", "lib.min.css", "other.js"}}
+	root := t.TempDir()
+
+	im := New().
+		WithDefaults().
+		RootDir(root).
+		WithProvider(pr).
+		WithPackages([]library.Package{
+			{Name: "lib", Require: library.Includes{{File: "lib.min.js", As: "lib"}, {File: "lib.min.css", As: "lib"}}},
+			{Name: "htmx", Provider: raw.New(srv.URL + "/htmx.min.js")},
+		})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.WriteFile(filepath.Join(root, "assets", "lib", "lib.min.js.gz"), []byte("gzipped"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h := im.Handler()
+
+	var tests = []struct {
+		path, encoding string
+		wantStatus     int
+		wantType       string
+		wantBody       string
+		wantContentEnc string
+	}{
+		{"/assets/lib/lib.min.js", "", http.StatusOK, "text/javascript; charset=utf-8", "/lib@1.0.0/lib.min.js", ""},
+		{"/assets/lib/lib.min.js", "gzip, br", http.StatusOK, "text/javascript; charset=utf-8", "gzipped", "gzip"},
+		{"/assets/lib/lib.min.css", "", http.StatusOK, "text/css; charset=utf-8", "/lib@1.0.0/lib.min.css", ""},
+		{"/assets/htmx/htmx", "", http.StatusOK, "text/javascript; charset=utf-8", "/htmx.min.js", ""},
+		{"/assets/lib/other.js", "", http.StatusNotFound, "", "", ""},
+		{"/assets/lib/../../importmap.lock.json", "", http.StatusNotFound, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+tt.encoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.encoding != "" {
+				req.Header.Set("Accept-Encoding", tt.encoding)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+				return
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if rec.Header().Get("Content-Type") != tt.wantType || rec.Header().Get("Content-Encoding") != tt.wantContentEnc || rec.Body.String() != tt.wantBody {
+				t.Errorf("unexpected response %v %q", rec.Header(), rec.Body.String())
+			}
+
+			// the ETag must result in a not modified response
+			req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNotModified {
+				t.Errorf("got status %d, want %d", rec.Code, http.StatusNotModified)
+			}
+		})
+	}
+}
+
+// countingFS counts the bytes read from its files
+type countingFS struct {
+	fs.FS
+	read *atomic.Int64
+}
+
+type countingFile struct {
+	fs.File
+	read *atomic.Int64
+}
+
+func (c countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingFile{File: f, read: c.read}, nil
+}
+
+func (f countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f countingFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func TestImportMapHandlerETag(t *testing.T) {
+	fsys := countingFS{
+		FS:   fstest.MapFS{"assets/app.js": &fstest.MapFile{Data: []byte("export default {};"), ModTime: time.Unix(1700000000, 0)}},
+		read: &atomic.Int64{},
+	}
+
+	im := New().WithFS(fsys)
+	im.Structure.Imports["app"] = "/assets/app.js"
+	h := im.Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/app.js", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == "" {
+		t.Errorf("unexpected response %d %v", rec.Code, rec.Header())
+		return
+	}
+
+	read := fsys.read.Load()
+
+	// a revalidation is answered from the etag cache without reading the file
+	req := httptest.NewRequest(http.MethodGet, "/assets/app.js", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	if fsys.read.Load() != read {
+		t.Errorf("the revalidation read %d bytes", fsys.read.Load()-read)
+	}
+}
+
+func TestImportMapFS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+
+	pr := &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.min.js"}}
+	root := t.TempDir()
+
+	newMap := func() *ImportMap {
+		return New().
+			WithDefaults().
+			WithProvider(pr).
+			WithIntegrity(library.SHA384).
+			WithPackage(library.Package{Name: "lib", Require: library.Includes{{File: "lib.min.js", As: "lib"}}})
+	}
+
+	online := newMap().WithStorage(library.DirStorage(root))
+	err := online.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	srv.Close()
+
+	// copy everything into memory the way //go:embed would compile it in
+	fsys := fstest.MapFS{}
+	err = fs.WalkDir(os.DirFS(root), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		b, err := os.ReadFile(filepath.Join(root, name))
+		fsys[name] = &fstest.MapFile{Data: b}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	embedded := newMap().WithFS(fsys).Offline(true)
+	err = embedded.CacheOrFetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want, _ := online.Imports()
+	got, _ := embedded.Imports()
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	embedded.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/lib/lib.min.js", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "/lib@1.0.0/lib.min.js" {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	err = newMap().WithFS(fsys).Fetch(t.Context())
+	if !errors.Is(err, library.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "importmap.json")
+
+	cfg := &Config{Provider: "jsdelivr"}
+	cfg.Set(PackageConfig{Name: "htmx.org", Version: "2.0.4", Require: []IncludeConfig{{File: "dist/htmx.min.js", As: "htmx"}}})
+	cfg.Set(PackageConfig{Name: "alpine", Provider: "raw", URL: "https://example.com/alpine.js"})
+	cfg.Set(PackageConfig{Name: "htmx.org", Version: "2.0.5", Require: []IncludeConfig{{File: "dist/htmx.min.js", As: "htmx"}}})
+
+	err := cfg.Write(name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	read, err := ReadConfig(name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(read.Packages) != 2 || read.Packages[0].Name != "alpine" || read.Get("htmx.org", "").Version != "2.0.5" {
+		t.Errorf("unexpected packages %+v", read.Packages)
+	}
+
+	im, err := read.ImportMap()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if library.ProviderName(im.provider) != "jsdelivr" || library.ProviderName(im.packages[0].Provider) != "raw" {
+		t.Errorf("unexpected providers %T %T", im.provider, im.packages[0].Provider)
+	}
+
+	if read.Remove("htmx.org", "/legacy/") || !read.Remove("htmx.org", "") || len(read.Packages) != 1 {
+		t.Errorf("unexpected packages after remove %+v", read.Packages)
+	}
+
+	read.Packages[0].URL = ""
+	if _, err = read.ImportMap(); err == nil {
+		t.Error("expected an error for a raw package without url")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	var tests = []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "valid",
+			content: "{\n  \"provider\": \"jsdelivr\",\n  \"rootDir\": \"web\",\n  \"packages\": [\n    {\"name\": \"htmx.org\", \"version\": \"2.0.4\", \"require\": [{\"file\": \"dist/htmx.min.js\", \"as\": \"htmx\"}]}\n  ]\n}\n",
+		},
+		{
+			name:    "syntax",
+			content: "{\n  \"packages\": [\n    {\"name\": \"a\",}\n  ]\n}\n",
+			want:    "syntax.json:3:18: invalid character ',' looking for beginning of value",
+		},
+		{
+			name:    "unknown field",
+			content: "{\n  \"packages\": [\n    {\"name\": \"a\", \"versoin\": \"1.0.0\"}\n  ]\n}\n",
+			want:    "unknown field.json:3:19: unknown field \"versoin\"",
+		},
+		{
+			name:    "provider",
+			content: "{\n  \"packages\": [\n    {\"name\": \"a\"},\n    {\"name\": \"b\", \"provider\": \"cdn\"}\n  ]\n}\n",
+			want:    "provider.json:4:31: unknown provider \"cdn\"",
+		},
+		{
+			name:    "raw",
+			content: "{\n  \"packages\": [\n    {\"name\": \"a\", \"provider\": \"raw\"}\n  ]\n}\n",
+			want:    "raw.json:3:31: the raw provider requires a url",
+		},
+		{
+			name:    "require",
+			content: "{\n  \"packages\": [\n    {\n      \"name\": \"a\",\n      \"require\": [{\"file\": \"a.js\"}, {\"as\": \"b\"}]\n    }\n  ]\n}\n",
+			want:    "require.json:5:37: require needs a file or a raw url",
+		},
+		{
+			name:    "entrypoint",
+			content: "{\n  \"entrypoints\": {\n    \"admin\": []\n  },\n  \"packages\": []\n}\n",
+			want:    "entrypoint.json:3:14: entrypoint \"admin\" selects nothing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, tt.name+".json")
+			err := os.WriteFile(name, []byte(tt.content), 0644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			im, err := LoadConfig(name)
+			if tt.want == "" {
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if im.rootDir != filepath.Join(dir, "web") || len(im.packages) != 1 || im.packages[0].Require[0].As != "htmx" {
+					t.Errorf("unexpected import map %s %+v", im.rootDir, im.packages)
+				}
+				return
+			}
+
+			var cfgErr *ConfigError
+			if !errors.As(err, &cfgErr) {
+				t.Errorf("expected a ConfigError, got %v", err)
+				return
+			}
+
+			if got := strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportMapVersionNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"name":"htmx","version":"2.0.4","versions":["2.0.3","2.0.4"],"assets":[{"version":"2.0.4","files":["htmx.min.js"]}]}`)
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	im := New().
+		WithDefaults().
+		RootDir(root).
+		WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL), cdnjs.WithCDNBase(srv.URL))).
+		WithPackage(library.Package{Name: "htmx", Version: "9.9.9"})
+
+	err := im.Fetch(t.Context())
+
+	var notFound *library.VersionNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("expected a VersionNotFoundError, got %v", err)
+		return
+	}
+
+	if notFound.Version != "9.9.9" || len(notFound.Nearby) != 2 {
+		t.Errorf("unexpected error %+v", notFound)
+	}
+
+	if _, err = os.Stat(filepath.Join(root, defaultCacheDir, "htmx")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no cache for an unknown version, got %v", err)
+	}
+}
+
+func TestImportMapDownloadError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(&testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.js"}}).
+		WithPackage(library.Package{Name: "lib"})
+
+	err := im.Fetch(t.Context())
+
+	var providerErr *library.ProviderError
+	if !errors.As(err, &providerErr) || !errors.Is(err, library.ErrFileNotFound) {
+		t.Errorf("expected a file not found ProviderError, got %v", err)
+		return
+	}
+
+	if providerErr.Package != "lib" || providerErr.StatusCode != http.StatusNotFound || providerErr.URL != srv.URL+"/lib@1.0.0/lib.js" {
+		t.Errorf("unexpected error %+v", providerErr)
+	}
+}
+
+func TestImportMapDownloadRecover(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && strings.HasSuffix(r.URL.Path, "/b.js") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("console.log('" + r.URL.Path + "')"))
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	newMap := func() *ImportMap {
+		return New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(&testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"a.js", "b.js"}}).
+			WithPackage(library.Package{Name: "lib"})
+	}
+
+	err := newMap().Fetch(t.Context())
+	if !errors.Is(err, library.ErrFileNotFound) {
+		t.Errorf("expected ErrFileNotFound, got %v", err)
+		return
+	}
+
+	// the failed download leaves no cache behind that a later run would take as complete
+	failing.Store(false)
+
+	im := newMap()
+	err = im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, ok := im.Structure.Imports["b.js"]; !ok {
+		t.Errorf("expected b.js after recovering, got %v", im.Structure.Imports)
+		return
+	}
+
+	im = newMap()
+	err = im.CacheOrFetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, ok := im.Structure.Imports["b.js"]; !ok {
+		t.Errorf("expected b.js from the cache, got %v", im.Structure.Imports)
+	}
+}
+
+func TestImportMapRetry(t *testing.T) {
+	var apiCalls, fileCalls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/htmx", func(w http.ResponseWriter, r *http.Request) {
+		if apiCalls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, `{"name":"htmx","version":"2.0.4","versions":["2.0.4"],"assets":[{"version":"2.0.4","files":["htmx.min.js"]}]}`)
+	})
+	mux.HandleFunc("/cdn/htmx/2.0.4/htmx.min.js", func(w http.ResponseWriter, r *http.Request) {
+		if fileCalls.Add(1) < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = io.WriteString(w, "htmx")
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL+"/api"), cdnjs.WithCDNBase(srv.URL+"/cdn"))).
+		WithRetry(library.Retry{BaseDelay: time.Millisecond}).
+		WithPackage(library.Package{Name: "htmx"})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if apiCalls.Load() != 2 || fileCalls.Load() != 3 {
+		t.Errorf("expected 2 api and 3 file requests, got %d and %d", apiCalls.Load(), fileCalls.Load())
+	}
+
+	// the last response is returned once the attempts are used up
+	fileCalls.Store(-10)
+	im = New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL+"/api"), cdnjs.WithCDNBase(srv.URL+"/cdn"))).
+		WithRetry(library.Retry{MaxAttempts: 2, BaseDelay: time.Millisecond}).
+		WithPackage(library.Package{Name: "htmx"})
+
+	err = im.Fetch(t.Context())
+	if !errors.Is(err, library.ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+
+	if fileCalls.Load() != -8 {
+		t.Errorf("expected 2 file requests, got %d", fileCalls.Load()+10)
+	}
+
+	// a Retry-After beyond the time budget is not waited for
+	fileCalls.Store(-10)
+	im = New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL+"/api"), cdnjs.WithCDNBase(srv.URL+"/cdn"))).
+		WithRetry(library.Retry{BaseDelay: time.Hour, MaxElapsed: time.Second}).
+		WithPackage(library.Package{Name: "htmx"})
+
+	err = im.Fetch(t.Context())
+	if !errors.Is(err, library.ErrRateLimited) || fileCalls.Load() != -9 {
+		t.Errorf("expected a single rate limited request, got %v after %d requests", err, fileCalls.Load()+10)
+	}
+
+	// a Retry-After beyond MaxDelay is not waited for, even without a time budget
+	mux.HandleFunc("/api/busy", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	im = New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL+"/api"), cdnjs.WithCDNBase(srv.URL+"/cdn"))).
+		WithRetry(library.Retry{}).
+		WithPackage(library.Package{Name: "busy"})
+
+	err = im.Fetch(ctx)
+	if !errors.Is(err, library.ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited without waiting, got %v", err)
+	}
+}
+
+type userAgentTransport string
+
+func (ua userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", string(ua))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestImportMapRetryProviderClient(t *testing.T) {
+	var calls, foreign atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.UserAgent() != "importmap-test" {
+			foreign.Add(1)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	provider := cdnjs.New(
+		cdnjs.WithAPIBase(srv.URL+"/api"),
+		cdnjs.WithCDNBase(srv.URL+"/cdn"),
+		cdnjs.WithHTTPClient(&http.Client{Transport: userAgentTransport("importmap-test")}),
+	)
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(provider).
+		WithRetry(library.Retry{MaxAttempts: 2, BaseDelay: time.Millisecond}).
+		WithPackages([]library.Package{{Name: "htmx"}, {Name: "alpinejs", Provider: provider}})
+
+	// fetching again must not wrap the retries of the previous run a second time
+	for range 2 {
+		_ = im.Fetch(t.Context())
+	}
+
+	if calls.Load() != 8 {
+		t.Errorf("expected 2 attempts per package and run, got %d requests", calls.Load())
+	}
+
+	if foreign.Load() != 0 {
+		t.Errorf("expected the client of the provider to be kept, %d requests without it", foreign.Load())
+	}
+}
+
+func TestImportMapDownloadValidation(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/html@1.0.0/lib.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<!DOCTYPE html><html><body>Not found</body></html>")
+	})
+	mux.HandleFunc("/large@1.0.0/lib.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		for range 4 {
+			_, _ = io.WriteString(w, strings.Repeat("x", 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/truncated@1.0.0/lib.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = io.WriteString(w, "export default")
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	defer func(size int64) {
+		library.MaxFileSize = size
+	}(library.MaxFileSize)
+	library.MaxFileSize = 1024
+
+	tests := []struct {
+		name string
+		want error
+	}{
+		{name: "html", want: library.ErrContentType},
+		{name: "large", want: library.ErrFileTooLarge},
+		{name: "truncated", want: io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		root := t.TempDir()
+		im := New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(&testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"lib.js"}}).
+			WithPackage(library.Package{Name: tt.name})
+
+		err := im.Fetch(t.Context())
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+			continue
+		}
+
+		// nothing, not even a temporary file, is left behind
+		entries, err := os.ReadDir(filepath.Join(root, defaultCacheDir, tt.name, "1.0.0"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Error(err)
+			continue
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s: expected an empty cache, got %d files", tt.name, len(entries))
+		}
+	}
+}
+
+func TestImportMapMetadataCache(t *testing.T) {
+	var full, notModified atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/htmx", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, `{"name":"htmx","version":"2.0.4","versions":["2.0.4"],"assets":[{"version":"2.0.4","files":["htmx.min.js"]}]}`)
+	})
+	mux.HandleFunc("/cdn/htmx/2.0.4/htmx.min.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "htmx")
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	root := t.TempDir()
+	fetch := func(ttl time.Duration) string {
+		// start over except for the metadata, otherwise the provider is not asked at all
+		for _, name := range []string{defaultAssetsDir, filepath.Join(defaultCacheDir, "htmx"), defaultLockFile} {
+			if err := os.RemoveAll(filepath.Join(root, name)); err != nil {
+				t.Error(err)
+			}
+		}
+
+		im := New().
+			WithDefaults().
+			RootDir(root).
+			WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL+"/api"), cdnjs.WithCDNBase(srv.URL+"/cdn"))).
+			WithMetadataCache(ttl).
+			WithPackage(library.Package{Name: "htmx"})
+
+		if err := im.Fetch(t.Context()); err != nil {
+			t.Error(err)
+			return ""
+		}
+
+		out, err := im.Imports()
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+
+		return string(out)
+	}
+
+	want := `{"imports":{"htmx.min.js":"/assets/htmx/htmx.min.js"}}`
+
+	if out := fetch(0); out != want || full.Load() != 1 || notModified.Load() != 0 {
+		t.Errorf("first fetch: got %s with %d full and %d conditional responses", out, full.Load(), notModified.Load())
+	}
+
+	// the stored ETag is revalidated
+	if out := fetch(0); out != want || full.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("revalidated fetch: got %s with %d full and %d conditional responses", out, full.Load(), notModified.Load())
+	}
+
+	// a fresh response is reused without a request
+	if out := fetch(time.Hour); out != want || full.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("cached fetch: got %s with %d full and %d conditional responses", out, full.Load(), notModified.Load())
+	}
+}
+
+func TestImportMapOutdated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"name":"htmx","version":"2.0.4","versions":["1.9.10","1.9.12","1.10.0","2.0.0-beta.1","2.0.4"]}`)
+	}))
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithProvider(cdnjs.New(cdnjs.WithAPIBase(srv.URL))).
+		WithPackages([]library.Package{
+			{Name: "htmx", Version: "1.9.10"},
+			{Name: "htmx", Version: "^1.9", Scope: "/legacy/"},
+			{Name: "latest"},
+			{Name: "raw", Provider: raw.New(srv.URL + "/raw.js")},
+		})
+
+	packages, err := im.Outdated(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := []OutdatedPackage{
+		{Name: "htmx", Provider: "cdnjs", Requested: "1.9.10", Current: "1.9.10", Patch: "1.9.12", Minor: "1.10.0", Major: "2.0.4"},
+		{Name: "htmx", Scope: "/legacy/", Provider: "cdnjs", Requested: "^1.9", Current: "1.10.0", Patch: "1.10.0", Minor: "1.10.0", Major: "2.0.4"},
+		{Name: "latest", Provider: "cdnjs", Current: "2.0.4", Patch: "2.0.4", Minor: "2.0.4", Major: "2.0.4"},
+	}
+
+	if len(packages) != len(want) {
+		t.Errorf("expected %d packages, got %+v", len(want), packages)
+		return
+	}
+
+	for i := range want {
+		if packages[i] != want[i] {
+			t.Errorf("expected %+v, got %+v", want[i], packages[i])
+		}
+	}
+
+	if !packages[0].Outdated() || packages[2].Outdated() {
+		t.Error("unexpected outdated state")
+	}
+}
+
+func TestImportMapPreload(t *testing.T) {
+	modules := map[string]string{
+		"/app@1.0.0/main.js":   `import{a}from"./util.js";import dep from "dep";const lazy=import("./lazy.js");`,
+		"/app@1.0.0/util.js":   `export * from "./shared.js";export const a=1;`,
+		"/app@1.0.0/shared.js": `export const b=2;`,
+		"/app@1.0.0/lazy.js":   `import "./never.js";`,
+		"/dep@2.0.0/index.js":  `export default {};`,
+		"/ui@3.0.0/ui.css":     `body{}`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, modules[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		ShimPath("").
+		WithPackages([]library.Package{
+			{
+				Name:     "app",
+				Provider: &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"main.js", "util.js", "shared.js", "lazy.js"}},
+				Require:  library.Includes{{File: "main.js", As: "app"}, {File: "util.js"}, {File: "shared.js"}, {File: "lazy.js"}},
+			},
+			{
+				Name:     "dep",
+				Provider: &testProvider{baseURL: srv.URL, version: "2.0.0", files: []string{"index.js"}},
+				Require:  library.Includes{{File: "index.js", As: "dep"}},
+			},
+			{
+				Name:     "ui",
+				Provider: &testProvider{baseURL: srv.URL, version: "3.0.0", files: []string{"ui.css"}},
+				Require:  library.Includes{{File: "ui.css", As: "ui"}},
+			},
+		})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plain, err := im.Render()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	out, err := im.RenderWith(RenderOptions{Preload: []string{"app"}, PreloadStyles: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := `<link rel="preload" href="/assets/ui/ui.css" as="style"/>
+` + string(plain) + `
+<link rel="modulepreload" href="/assets/app/main.js"/>
+<link rel="modulepreload" href="/assets/app/util.js"/>
+<link rel="modulepreload" href="/assets/dep/index.js"/>
+<link rel="modulepreload" href="/assets/app/shared.js"/>`
+
+	if string(out) != want {
+		t.Errorf("unexpected html\n%s\nwant\n%s", out, want)
+	}
+
+	_, err = im.RenderWith(RenderOptions{Preload: []string{"missing"}})
+	if err == nil {
+		t.Error("expected an error for an unknown specifier")
+	}
+}
+
+func TestImportMapNonce(t *testing.T) {
+	im := New().RootDir(t.TempDir()).ShimPath("/shim.js")
+	im.Structure.Imports["app"] = "/assets/app.js"
+	im.Structure.Styles["ui"] = "/assets/ui.css"
+
+	out, err := im.RenderWith(RenderOptions{Nonce: `r4nd"0m`, Preload: []string{"app"}, PreloadStyles: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	html := string(out)
+	tags := strings.Count(html, "<script") + strings.Count(html, "<link")
+	if tags != 5 || strings.Count(html, ` nonce="r4nd&#34;0m"`) != tags {
+		t.Errorf("expected the escaped nonce on all 5 tags, got\n%s", html)
+	}
+
+	out, err = im.Render()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if strings.Contains(string(out), "nonce") {
+		t.Errorf("unexpected nonce in %s", out)
+	}
+}
+
+func TestImportMapStyleOrder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "body{}")
+	}))
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		WithPackages([]library.Package{
+			{
+				Name:     "bootstrap",
+				Provider: &testProvider{baseURL: srv.URL, version: "5.3.3", files: []string{"a.css", "b.css", "c.css"}},
+				Require:  library.Includes{{File: "c.css", As: "grid"}, {File: "a.css", As: "bootstrap"}},
+			},
+			{
+				Name:     "theme",
+				Provider: &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"theme.css"}},
+			},
+			{
+				Name:     "reset",
+				Provider: &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"reset.css"}},
+				Require:  library.Includes{{File: "reset.css", As: "reset", Order: -1}},
+			},
+		})
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	im.Structure.Styles["extra"] = "/extra.css"
+
+	want := `<link rel="stylesheet" href="/assets/reset/reset.css" as="reset">` +
+		`<link rel="stylesheet" href="/assets/bootstrap/c.css" as="grid">` +
+		`<link rel="stylesheet" href="/assets/bootstrap/a.css" as="bootstrap">` +
+		`<link rel="stylesheet" href="/assets/theme/theme.css" as="theme.css">` +
+		`<link rel="stylesheet" href="/extra.css" as="extra">`
+
+	// map iteration order differs between calls, the output must not
+	for range 20 {
+		out, err := im.Styles()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(out) != want {
+			t.Errorf("unexpected styles\n%s\nwant\n%s", out, want)
+			return
+		}
+	}
+}
+
+func TestImportMapFuncMap(t *testing.T) {
+	im := New().RootDir(t.TempDir()).ShimPath("/shim.js")
+
+	tmpl, err := template.New("layout").Funcs(im.FuncMap()).Parse(`{{ importmapStyles }}
+{{ importmapShim .Nonce }}
+{{ importmap .Nonce }}
+{{ importmapPreload "app" }}
+<script type="module" src="{{ importmapPath "app" }}"></script>
+<a href="/?next={{ importmapPath "ui" }}">`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the functions read the ImportMap when the template executes
+	im.Structure.Imports["app"] = "/assets/app.js?v=1&x=2"
+	im.Structure.Styles["ui"] = "/assets/ui.css"
+
+	var buf strings.Builder
+	err = tmpl.Execute(&buf, map[string]string{"Nonce": "n0nce"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := `<link rel="stylesheet" href="/assets/ui.css" as="ui"/>
+<script async src="/shim.js" nonce="n0nce"></script>
+<script type="importmap" nonce="n0nce">
+{
+  "imports": {
+    "app": "/assets/app.js?v=1\u0026x=2"
+  }
+}
+</script>
+<link rel="modulepreload" href="/assets/app.js?v=1&amp;x=2"/>
+<script type="module" src="/assets/app.js?v=1&amp;x=2"></script>
+<a href="/?next=%2fassets%2fui.css">`
+
+	if buf.String() != want {
+		t.Errorf("unexpected html\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	err = tmpl.Execute(io.Discard, nil)
+	if err == nil {
+		t.Error("expected an error for the missing nonce field")
+	}
+
+	_, err = im.Path("missing")
+	if err == nil {
+		t.Error("expected an error for an unknown specifier")
+		return
+	}
+
+	// render options from the template data carry the nonce and the entrypoint of the page
+	im.Structure.Imports["admin"] = "/assets/admin.js"
+	im.WithEntrypoint("public", "app")
+
+	tmpl, err = template.New("page").Funcs(im.FuncMap()).Parse(`{{ importmap .Options }}
+{{ importmapPreload .Options "app" }}
+{{ importmapPreload .Options }}`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf.Reset()
+	err = tmpl.Execute(&buf, map[string]any{"Options": RenderOptions{Nonce: "n0nce", Entrypoint: "public"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want = `<script type="importmap" nonce="n0nce">
+{
+  "imports": {
+    "app": "/assets/app.js?v=1\u0026x=2"
+  }
+}
+</script>
+<link rel="modulepreload" href="/assets/app.js?v=1&amp;x=2" nonce="n0nce"/>
+`
+
+	if buf.String() != want {
+		t.Errorf("unexpected html\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	tmpl = template.Must(template.New("invalid").Funcs(im.FuncMap()).Parse(`{{ importmap "a" "b" }}`))
+	err = tmpl.Execute(io.Discard, nil)
+	if err == nil {
+		t.Error("expected an error for more than one nonce")
+	}
+}
+
+func TestImportMapEntrypoints(t *testing.T) {
+	modules := map[string]string{
+		"/admin@1.0.0/main.js":   `import chart from "chart";const editor=()=>import("editor");`,
+		"/admin@1.0.0/admin.css": `table{}`,
+		"/chart@2.0.0/index.js":  `export default {};`,
+		"/editor@3.0.0/index.js": `export default {};`,
+		"/public@1.0.0/main.js":  `import "./util.js";`,
+		"/public@1.0.0/util.js":  `export const a=1;`,
+		"/ui@1.0.0/ui.css":       `body{}`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, modules[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	im := New().
+		WithDefaults().
+		RootDir(t.TempDir()).
+		ShimPath("").
+		WithPackages([]library.Package{
+			{
+				Name:     "admin",
+				Provider: &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"main.js", "admin.css"}},
+				Require:  library.Includes{{File: "main.js", As: "admin"}, {File: "admin.css", As: "admin.css"}},
+			},
+			{
+				Name:     "chart",
+				Provider: &testProvider{baseURL: srv.URL, version: "2.0.0", files: []string{"index.js"}},
+				Require:  library.Includes{{File: "index.js", As: "chart"}},
+			},
+			{
+				Name:     "editor",
+				Provider: &testProvider{baseURL: srv.URL, version: "3.0.0", files: []string{"index.js"}},
+				Require:  library.Includes{{File: "index.js", As: "editor"}},
+			},
+			{
+				Name:     "public",
+				Provider: &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"main.js", "util.js"}},
+				Require:  library.Includes{{File: "main.js", As: "public"}, {File: "util.js"}},
+			},
+			{
+				Name:     "ui",
+				Provider: &testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"ui.css"}},
+				Require:  library.Includes{{File: "ui.css", As: "ui"}},
+			},
+		}).
+		WithEntrypoint("admin", "admin").
+		WithEntrypoint("public", "public", "ui")
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for entrypoint, want := range map[string]string{
+		"admin":  `{"imports":{"admin":"/assets/admin/main.js","chart":"/assets/chart/index.js","editor":"/assets/editor/index.js"}}`,
+		"public": `{"imports":{"public":"/assets/public/main.js","util":"/assets/public/util.js"}}`,
+	} {
+		out, err := im.ImportsFor(entrypoint)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(out) != want {
+			t.Errorf("%s: got %s, want %s", entrypoint, out, want)
+		}
+	}
+
+	out, err := im.RenderStyles(RenderOptions{Entrypoint: "public"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want := `<link rel="stylesheet" href="/assets/ui/ui.css" as="ui"/>`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+
+	_, err = im.RenderWith(RenderOptions{Entrypoint: "public", Preload: []string{"admin"}})
+	if err == nil {
+		t.Error("expected an error for a preload outside of the entrypoint")
+	}
+
+	_, err = im.RenderWith(RenderOptions{Entrypoint: "missing"})
+	if err == nil {
+		t.Error("expected an error for an unknown entrypoint")
+	}
+
+	im.WithEntrypoint("broken", "missing")
+	_, err = im.ImportsFor("broken")
+	if err == nil {
+		t.Error("expected an error for an unknown selector")
+	}
+}
+
+func TestImportMapEntrypointDependencies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	pr := &testResolverProvider{
+		testProvider: testProvider{baseURL: srv.URL, version: "1.0.0", files: []string{"index.js"}},
+		deps: map[string][]library.Dependency{
+			"app@1.0.0":   {{Name: "hooks", Version: "2.0.0", Entry: "index.js"}},
+			"hooks@2.0.0": {{Name: "util", Version: "1.2.3", Entry: "index.js"}},
+		},
+	}
+
+	im := New().
+		CacheDir(defaultCacheDir).
+		RootDir(t.TempDir()).
+		WithProvider(pr).
+		WithDependencies(true).
+		WithPackages([]library.Package{
+			{Name: "app", Require: library.Includes{{File: "index.js", As: "app"}}},
+			{Name: "other", Require: library.Includes{{File: "index.js", As: "other"}}},
+		}).
+		WithEntrypoint("app", "app")
+
+	err := im.Fetch(t.Context())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// remote modules can not be read, the resolved dependencies of the package are included instead
+	out, err := im.ImportsFor("app")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := `{"imports":{"app":"` + srv.URL + `/app@1.0.0/index.js","hooks":"` + srv.URL + `/hooks@2.0.0/index.js","hooks/":"` + srv.URL + `/hooks@2.0.0/",` +
+		`"util":"` + srv.URL + `/util@1.2.3/index.js","util/":"` + srv.URL + `/util@1.2.3/"}}`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
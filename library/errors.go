@@ -0,0 +1,87 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrPackageNotFound is matched when a provider does not know the package
+	ErrPackageNotFound = errors.New("package not found")
+	// ErrFileNotFound is matched when a file of a package can not be downloaded because it does not exist
+	ErrFileNotFound = errors.New("file not found")
+	// ErrRateLimited is matched when a provider or CDN refuses requests because too many were made
+	ErrRateLimited = errors.New("rate limited")
+	// ErrContentType is matched when a downloaded js or css file turns out to be something else, e.g. an html error page
+	ErrContentType = errors.New("unexpected content type")
+	// ErrFileTooLarge is matched when a downloaded file exceeds MaxFileSize
+	ErrFileTooLarge = errors.New("file too large")
+)
+
+// ProviderError is returned when a request to a provider or CDN fails. Err holds the cause, which is one
+// of the sentinel errors of this package for known status codes, so errors.Is(err, ErrRateLimited) works.
+type ProviderError struct {
+	Provider   string
+	Package    string
+	Version    string
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	name := e.Package
+	if e.Version != "" {
+		name += "@" + e.Version
+	}
+
+	msg := e.Provider
+	if msg == "" {
+		msg = "download"
+	}
+	if name != "" {
+		msg += " " + name
+	}
+
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: %s responded with code %d: %v", msg, e.URL, e.StatusCode, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %s: %v", msg, e.URL, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// ResponseError returns a *ProviderError when the response is not successful, nil otherwise. A 404 wraps
+// notFound, a 429 wraps ErrRateLimited.
+func ResponseError(resp *http.Response, provider, name, version string, notFound error) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err := &ProviderError{
+		Provider:   provider,
+		Package:    name,
+		Version:    version,
+		StatusCode: resp.StatusCode,
+		Err:        errors.New(http.StatusText(resp.StatusCode)),
+	}
+
+	if resp.Request != nil {
+		err.URL = resp.Request.URL.String()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if notFound != nil {
+			err.Err = notFound
+		}
+	case http.StatusTooManyRequests:
+		err.Err = ErrRateLimited
+	}
+
+	return err
+}
@@ -23,7 +23,7 @@ type File struct {
 
 func ExtractFileType(filename string) FileType {
 	switch filepath.Ext(filename) {
-	case ".js":
+	case ".js", ".mjs":
 		return FileTypeJS
 	case ".css":
 		return FileTypeCSS
@@ -0,0 +1,119 @@
+package library
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// fingerprintLength is the number of hex characters of the content hash used in file names
+const fingerprintLength = 8
+
+// fingerprintPattern matches the fingerprint at the end of the name, or before the extension when there is one
+var fingerprintPattern = regexp.MustCompile(fmt.Sprintf(`\.[0-9a-f]{%d}(\.[^./]+)?$`, fingerprintLength))
+
+// FingerprintPath inserts the fingerprint before the extension, e.g. htmx.min.js becomes htmx.min.3f9a1c2b.js.
+// A path without extension, like the files of the raw provider, gets the fingerprint appended: htmx.3f9a1c2b
+func FingerprintPath(filePath string, fingerprint string) string {
+	ext := path.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + "." + fingerprint + ext
+}
+
+// StripFingerprint returns the path without its fingerprint, paths without a fingerprint are returned unchanged
+func StripFingerprint(filePath string) string {
+	return fingerprintPattern.ReplaceAllString(filePath, "$1")
+}
+
+// IsFingerprinted reports whether the path carries a fingerprint
+func IsFingerprinted(filePath string) bool {
+	return fingerprintPattern.MatchString(filePath)
+}
+
+// Fingerprint returns the fingerprint of the content
+func Fingerprint(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:fingerprintLength]
+}
+
+// MakeFingerprintedAssets copies the cache file to the asset path with a fingerprint of its content in
+// the name, without cache the file is downloaded with the client. Older fingerprints of the same file
+// are removed. It returns the fingerprinted path relative to the assets dir of the package.
+func (p *Package) MakeFingerprintedAssets(ctx context.Context, client *http.Client, st Storage, cacheDir string, assetsDir string, filePath string, src string) (string, error) {
+	var content []byte
+
+	if cacheDir != "" && p.HasCacheFile(st, cacheDir, filePath) {
+		var err error
+		content, err = fs.ReadFile(st, strings.TrimPrefix(path.Join(p.CacheDir(cacheDir), filePath), "/"))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		body, err := p.download(ctx, client, filePath, src)
+		if err != nil {
+			return "", err
+		}
+		content, err = io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	assetPath := FingerprintPath(filePath, Fingerprint(content))
+	fullPath := path.Join(p.AssetsDir(assetsDir), assetPath)
+
+	if !p.HasAssetFile(st, assetsDir, assetPath) {
+		err := st.WriteFile(fullPath, bytes.NewReader(content))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// remove the fingerprints of previous versions
+	entries, err := fs.ReadDir(st, strings.TrimPrefix(path.Dir(fullPath), "/"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == path.Base(assetPath) || !IsFingerprinted(e.Name()) {
+			continue
+		}
+
+		if StripFingerprint(e.Name()) == path.Base(filePath) {
+			err = st.RemoveAll(path.Join(path.Dir(fullPath), e.Name()))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return assetPath, nil
+}
+
+// FingerprintedAsset looks up an existing fingerprinted asset of the file, it returns the fingerprinted
+// path relative to the assets dir of the package
+func (p *Package) FingerprintedAsset(fsys fs.FS, assetsDir string, filePath string) (string, bool) {
+	dir := path.Dir(filePath)
+
+	entries, err := fs.ReadDir(fsys, strings.TrimPrefix(path.Join(p.AssetsDir(assetsDir), dir), "/"))
+	if err != nil {
+		return "", false
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() && IsFingerprinted(e.Name()) && StripFingerprint(e.Name()) == path.Base(filePath) {
+			return path.Join(dir, e.Name()), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,175 @@
+package library
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// MetadataCache is an http.RoundTripper persisting successful GET responses in a storage. Stored responses
+// younger than TTL are served without a request, older ones are revalidated with If-None-Match and
+// If-Modified-Since so an unchanged response costs a 304 instead of the full body. It is meant for the
+// metadata requests of providers, not for file downloads.
+type MetadataCache struct {
+	Storage   Storage
+	Dir       string            // dir in the storage holding the responses
+	TTL       time.Duration     // age up to which responses are served without revalidation, 0 always revalidates
+	Transport http.RoundTripper // transport making the requests, nil uses http.DefaultTransport
+}
+
+// cachedResponse is the first line of a stored response, the body follows it
+type cachedResponse struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Stored       time.Time `json:"stored"`
+}
+
+// Client returns a copy of c whose transport caches, wrapping the transport of c. A nil c copies
+// http.DefaultClient.
+func (m MetadataCache) Client(c *http.Client) *http.Client {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	caching := *c
+	if m.Transport == nil {
+		m.Transport = c.Transport
+	}
+	caching.Transport = &m
+
+	return &caching
+}
+
+func (m *MetadataCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := m.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if req.Method != http.MethodGet || m.Storage == nil {
+		return transport.RoundTrip(req)
+	}
+
+	name := m.name(req)
+	entry, body, ok := m.load(name)
+	if ok && m.TTL > 0 && time.Since(entry.Stored) < m.TTL {
+		return entry.response(req, body), nil
+	}
+
+	conditional := req
+	if ok && (entry.ETag != "" || entry.LastModified != "") {
+		conditional = req.Clone(req.Context())
+		if entry.ETag != "" {
+			conditional.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			conditional.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := transport.RoundTrip(conditional)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ok && resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close()
+
+		entry.Stored = time.Now()
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			entry.ETag = etag
+		}
+		m.store(name, entry, body)
+
+		return entry.response(req, body), nil
+	case resp.StatusCode == http.StatusOK:
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		m.store(name, cachedResponse{
+			URL:          req.URL.String(),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			ContentType:  resp.Header.Get("Content-Type"),
+			Stored:       time.Now(),
+		}, body)
+
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return resp, nil
+	}
+
+	return resp, nil
+}
+
+// name returns the name of the stored response, the Accept header is part of it as the npm registry
+// serves different documents depending on it
+func (m *MetadataCache) name(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.String() + "\n" + req.Header.Get("Accept")))
+	return strings.TrimPrefix(path.Join(m.Dir, hex.EncodeToString(sum[:])), "/")
+}
+
+func (m *MetadataCache) load(name string) (cachedResponse, []byte, bool) {
+	var entry cachedResponse
+
+	b, err := fs.ReadFile(m.Storage, name)
+	if err != nil {
+		return entry, nil, false
+	}
+
+	header, body, found := bytes.Cut(b, []byte("\n"))
+	if !found || json.Unmarshal(header, &entry) != nil {
+		return entry, nil, false
+	}
+
+	return entry, body, true
+}
+
+// store writes the response, failures are ignored as the response is simply requested again next time
+func (m *MetadataCache) store(name string, entry cachedResponse, body []byte) {
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	_ = m.Storage.WriteFile(name, io.MultiReader(bytes.NewReader(header), strings.NewReader("\n"), bytes.NewReader(body)))
+}
+
+// response returns the stored response as if it was just received
+func (e cachedResponse) response(req *http.Request, body []byte) *http.Response {
+	header := make(http.Header)
+	if e.ContentType != "" {
+		header.Set("Content-Type", e.ContentType)
+	}
+	if e.ETag != "" {
+		header.Set("ETag", e.ETag)
+	}
+	if e.LastModified != "" {
+		header.Set("Last-Modified", e.LastModified)
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
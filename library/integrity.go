@@ -0,0 +1,74 @@
+package library
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+const (
+	// SHA256 represents the sha256 digest
+	SHA256 HashAlgorithm = "sha256"
+	// SHA384 represents the sha384 digest
+	SHA384 HashAlgorithm = "sha384"
+	// SHA512 represents the sha512 digest
+	SHA512 HashAlgorithm = "sha512"
+)
+
+// HashAlgorithm is the digest used to build an integrity value
+type HashAlgorithm string
+
+func (a HashAlgorithm) hash() (hash.Hash, error) {
+	switch a {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA384:
+		return sha512.New384(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", string(a))
+	}
+}
+
+// Integrity returns the subresource integrity value of the content of r, e.g. "sha384-<base64>"
+func Integrity(r io.Reader, algo HashAlgorithm) (string, error) {
+	h, err := algo.hash()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return string(algo) + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// FileIntegrity returns the subresource integrity value of the file on disk
+func FileIntegrity(name string, algo HashAlgorithm) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return Integrity(file, algo)
+}
+
+// FSIntegrity returns the subresource integrity value of the named file in fsys
+func FSIntegrity(fsys fs.FS, name string, algo HashAlgorithm) (string, error) {
+	file, err := fsys.Open(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return Integrity(file, algo)
+}
@@ -1,14 +1,16 @@
 package library
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -17,16 +19,67 @@ type Provider interface {
 	FetchPackageFiles(ctx context.Context, name, version string) (Files, string, error)
 }
 
+// HTTPClientSetter is implemented by providers that accept an http client after they are constructed
+type HTTPClientSetter interface {
+	SetHTTPClient(c *http.Client)
+}
+
+// HTTPClientGetter is implemented by providers that expose their http client, so it can be wrapped instead of replaced
+type HTTPClientGetter interface {
+	HTTPClient() *http.Client
+}
+
+// DependencyResolver is implemented by providers that can list the runtime dependencies of a package version
+type DependencyResolver interface {
+	FetchDependencies(ctx context.Context, name, version string) ([]Dependency, error)
+}
+
+// VersionLister is implemented by providers that can list the published versions of a package
+type VersionLister interface {
+	FetchVersions(ctx context.Context, name string) ([]string, error)
+}
+
+// Dependency is a runtime dependency of a package, resolved to an exact version
+type Dependency struct {
+	Name    string
+	Version string
+	Entry   string // local path of the file the bare specifier resolves to, empty when there is no ES module to import
+}
+
+// NamedProvider is implemented by providers that can identify themselves, the name is recorded in the lockfile
+type NamedProvider interface {
+	Name() string
+}
+
+// ProviderName returns the name of the provider, falling back to its type when it does not implement NamedProvider
+func ProviderName(p Provider) string {
+	if np, ok := p.(NamedProvider); ok {
+		return np.Name()
+	}
+
+	return fmt.Sprintf("%T", p)
+}
+
 type Includes []Include
 
 type Include struct {
-	File string
-	Raw  string
-	As   string
+	File  string
+	Raw   string
+	As    string
+	Order int // position of a stylesheet among all stylesheets, lower renders first, equal orders keep the package and Require order
 }
 
 func (I Includes) Get(s string) *Include {
-	for _, i := range I {
+	if i := I.Index(s); i >= 0 {
+		return &I[i]
+	}
+
+	return nil
+}
+
+// Index returns the position of the first include matching the file, -1 when none matches
+func (I Includes) Index(s string) int {
+	for idx, i := range I {
 		// Compile the pattern, assuming 'File' is a valid regex pattern
 		pattern := "^" + strings.Trim(i.File, `/`) + "$"    // Ensure the pattern matches the entire string
 		pattern = strings.Replace(pattern, "**/", "**", -1) // Ensure the pattern matches the entire string
@@ -40,12 +93,12 @@ func (I Includes) Get(s string) *Include {
 			continue // For this example, we'll just skip this iteration
 		}
 
-		if re.MatchString(s) {
-			return &i
+		if re.MatchString(strings.TrimPrefix(s, "/")) {
+			return idx
 		}
 	}
 
-	return nil
+	return -1
 }
 
 func (I Include) Name() string {
@@ -70,74 +123,147 @@ type Package struct {
 	Version  string
 	Provider Provider
 	Require  Includes // Patterns to specify which files to include
+	Scope    string   // URL prefix in which the package overrides the top level imports, e.g. "/assets/legacy/"
 }
 
 // CacheDir returns the cache dir for the current package, we will store all files in here
 func (p *Package) CacheDir(cacheDir string) string {
-	version := "latest"
+	return path.Join(cacheDir, p.Name, p.version())
+}
+
+func (p *Package) version() string {
 	if p.Version != "" {
-		version = p.Version
+		return p.Version
 	}
-	return path.Join(cacheDir, p.Name, version)
+	return "latest"
+}
+
+// HasCache checks if the package has cache in the file system
+func (p *Package) HasCache(fsys fs.FS, cacheDir string) bool {
+	return exists(fsys, p.CacheDir(cacheDir))
 }
 
-// HasCache checks if the package has cache on disk
-func (p *Package) HasCache(rootDir string, cacheDir string) bool {
-	fullPath := path.Join(rootDir, p.CacheDir(cacheDir))
+// HasCacheFile checks if a single file of the package is cached in the file system
+func (p *Package) HasCacheFile(fsys fs.FS, cacheDir string, filePath string) bool {
+	return exists(fsys, path.Join(p.CacheDir(cacheDir), filePath))
+}
 
-	if _, err := os.Stat(fullPath); errors.Is(err, os.ErrNotExist) {
-		return false
+// MakeCache retrieves the file from the remote server and stores it locally, a nil client uses http.DefaultClient
+func (p *Package) MakeCache(ctx context.Context, client *http.Client, st Storage, cacheDir string, filePath string, src string) error {
+	body, err := p.download(ctx, client, filePath, src)
+	if err != nil {
+		return err
 	}
+	defer body.Close()
 
-	return true
+	return st.WriteFile(path.Join(p.CacheDir(cacheDir), filePath), body)
 }
 
-// MakeCache retrieves the file from the remote server and stores it locally
-func (p *Package) MakeCache(rootDir string, cacheDir string, filePath string, src string) error {
-	fullPath := path.Join(rootDir, p.CacheDir(cacheDir), filePath)
+// MaxFileSize is the upper bound in bytes of a single downloaded file, larger files fail with
+// ErrFileTooLarge. Zero disables the limit.
+var MaxFileSize int64 = 64 << 20
 
-	err := os.MkdirAll(filepath.Dir(fullPath), os.FileMode(0755))
-	if err != nil {
-		return err
+// sniffLength is the number of leading bytes of a download inspected for html
+const sniffLength = 512
+
+// download retrieves the remote file, the caller closes the returned body. Unsuccessful responses, html
+// served for a js or css file and files exceeding MaxFileSize are returned as *ProviderError, a body
+// growing beyond MaxFileSize while it is read fails with the same error.
+func (p *Package) download(ctx context.Context, client *http.Client, filePath string, src string) (io.ReadCloser, error) {
+	if client == nil {
+		client = http.DefaultClient
 	}
 
-	file, err := os.Create(fullPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
-	resp, err := http.Get(src)
+	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return err
+	if err = ResponseError(resp, "", p.Name, p.Version, ErrFileNotFound); err != nil {
+		resp.Body.Close()
+		return nil, err
 	}
 
-	return nil
+	fail := func(cause error) error {
+		return &ProviderError{Package: p.Name, Version: p.Version, URL: src, StatusCode: resp.StatusCode, Err: cause}
+	}
+
+	if MaxFileSize > 0 && resp.ContentLength > MaxFileSize {
+		resp.Body.Close()
+		return nil, fail(fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrFileTooLarge, resp.ContentLength, MaxFileSize))
+	}
+
+	body := bufio.NewReaderSize(resp.Body, sniffLength)
+	if fileType := ExtractFileType(filePath); fileType == FileTypeJS || fileType == FileTypeCSS {
+		// a short body is fine, Peek then returns what there is together with io.EOF
+		head, _ := body.Peek(sniffLength)
+		if mediaType := htmlContent(resp.Header.Get("Content-Type"), head); mediaType != "" {
+			resp.Body.Close()
+			return nil, fail(fmt.Errorf("%w: %s for a %s file", ErrContentType, mediaType, fileType))
+		}
+	}
+
+	limit := MaxFileSize
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+
+	return &limitedBody{Reader: body, Closer: resp.Body, remaining: limit, err: fail(ErrFileTooLarge)}, nil
 }
 
-// AssetsDir returns the assets dir for the current package, we will store all files in here
-func (p *Package) AssetsDir(assets string) string {
-	return path.Join(assets, p.Name)
+// htmlContent returns the media type when the content type or the first bytes of the body indicate html
+func htmlContent(contentType string, head []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		return mediaType
+	}
+
+	head = bytes.ToLower(bytes.TrimLeft(head, "\ufeff \t\r\n"))
+	if bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html")) {
+		return "text/html"
+	}
+
+	return ""
+}
+
+// limitedBody fails with err once more than remaining bytes are read
+type limitedBody struct {
+	io.Reader
+	io.Closer
+	remaining int64
+	err       error
 }
 
-// HasAssets checks if the package has assets on disk
-func (p *Package) HasAssets(rootDir string, assetsDir string) bool {
-	fullPath := path.Join(rootDir, p.AssetsDir(assetsDir))
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, b.err
+	}
+
+	return n, err
+}
 
-	if _, err := os.Stat(fullPath); errors.Is(err, os.ErrNotExist) {
-		return false
+// AssetsDir returns the assets dir for the current package, we will store all files in here.
+// Scoped packages live next to the top level version of the same package, so their dir includes the version.
+func (p *Package) AssetsDir(assets string) string {
+	if p.Scope != "" {
+		return path.Join(assets, p.Name+"@"+p.version())
 	}
+	return path.Join(assets, p.Name)
+}
 
-	return true
+// HasAssets checks if the package has assets in the file system
+func (p *Package) HasAssets(fsys fs.FS, assetsDir string) bool {
+	return exists(fsys, p.AssetsDir(assetsDir))
 }
 
-func (p *Package) Assets(assetsDir string, filePath string) (Files, string, error) {
+func (p *Package) Assets(fsys fs.FS, assetsDir string, filePath string) (Files, string, error) {
 	// If filePath is empty, list all files in the package's asset directory
 	baseDir := p.AssetsDir(assetsDir)
 	var fullPath string
@@ -149,17 +275,23 @@ func (p *Package) Assets(assetsDir string, filePath string) (Files, string, erro
 		fullPath = path.Join(baseDir, filePath)
 	}
 
-	if _, err := os.Stat(fullPath); errors.Is(err, os.ErrNotExist) {
+	if !exists(fsys, fullPath) {
 		return nil, "", fmt.Errorf("asset file %s does not exist", fullPath)
 	}
 
 	// Use a recursive helper function to traverse directories
-	return p.getFilesRecursively(fullPath, baseDir, filePath)
+	return p.getFilesRecursively(fsys, fullPath, baseDir, filePath)
+}
+
+// CachedFiles lists all files in the cache dir of the package
+func (p *Package) CachedFiles(fsys fs.FS, cacheDir string) (Files, error) {
+	files, _, err := p.getFilesRecursively(fsys, p.CacheDir(cacheDir), p.CacheDir(cacheDir), "")
+	return files, err
 }
 
 // getFilesRecursively will scan a directory and all its subdirectories for files
-func (p *Package) getFilesRecursively(fullPath, baseDir, relativePath string) (Files, string, error) {
-	files, err := os.ReadDir(fullPath)
+func (p *Package) getFilesRecursively(fsys fs.FS, fullPath, baseDir, relativePath string) (Files, string, error) {
+	files, err := fs.ReadDir(fsys, strings.TrimPrefix(fullPath, "/"))
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to read directory %s: %w", fullPath, err)
 	}
@@ -172,7 +304,7 @@ func (p *Package) getFilesRecursively(fullPath, baseDir, relativePath string) (F
 
 		if file.IsDir() {
 			// Recursively process subdirectory
-			subFiles, _, err := p.getFilesRecursively(currentFullPath, baseDir, currentRelativePath)
+			subFiles, _, err := p.getFilesRecursively(fsys, currentFullPath, baseDir, currentRelativePath)
 			if err != nil {
 				return nil, "", err
 			}
@@ -198,56 +330,27 @@ func (p *Package) getFilesRecursively(fullPath, baseDir, relativePath string) (F
 	return assetFiles, baseDir, nil
 }
 
-func (p *Package) HasAssetFile(rootDir string, assetsDir string, filePath string) bool {
-	fullPath := path.Join(rootDir, p.AssetsDir(assetsDir), filePath)
-
-	if _, err := os.Stat(fullPath); errors.Is(err, os.ErrNotExist) {
-		return false
-	}
-
-	return true
+func (p *Package) HasAssetFile(fsys fs.FS, assetsDir string, filePath string) bool {
+	return exists(fsys, path.Join(p.AssetsDir(assetsDir), filePath))
 }
 
-// MakeAssets copies the cache files to the asset path without the version
-func (p *Package) MakeAssets(rootDir string, cacheDir string, assetsDir string, filePath string, src string) error {
-	fullPath := path.Join(rootDir, p.AssetsDir(assetsDir), filePath)
+// MakeAssets copies the cache files to the asset path without the version, without cache the file is
+// downloaded with the client, a nil client uses http.DefaultClient
+func (p *Package) MakeAssets(ctx context.Context, client *http.Client, st Storage, cacheDir string, assetsDir string, filePath string, src string) error {
+	var (
+		body io.ReadCloser
+		err  error
+	)
 
-	err := os.MkdirAll(filepath.Dir(fullPath), os.FileMode(0755))
-	if err != nil {
-		return err
-	}
-
-	file, err := os.Create(fullPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	if cacheDir != "" && p.HasCache(rootDir, cacheDir) {
-		cachePath := path.Join(rootDir, p.CacheDir(cacheDir), filePath)
-		cacheFile, err := os.Open(cachePath)
-		if err != nil {
-			return err
-		}
-
-		_, err = io.Copy(file, cacheFile)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	}
-
-	resp, err := http.Get(src)
-	if err != nil {
-		return err
+	if cacheDir != "" && p.HasCache(st, cacheDir) {
+		body, err = st.Open(path.Join(p.CacheDir(cacheDir), filePath))
+	} else {
+		body, err = p.download(ctx, client, filePath, src)
 	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(file, resp.Body)
 	if err != nil {
 		return err
 	}
+	defer body.Close()
 
-	return nil
+	return st.WriteFile(path.Join(p.AssetsDir(assetsDir), filePath), body)
 }
@@ -0,0 +1,64 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Registry reads the published versions of packages from an npm registry, for the providers serving npm packages
+type Registry struct {
+	BaseURL  string       // base URL of the registry ending in a slash, e.g. https://registry.npmjs.org/
+	Client   *http.Client // client making the requests, nil uses http.DefaultClient
+	Provider string       // name of the provider reported in errors
+}
+
+// Resolve resolves a version, dist-tag or range against the versions of the package
+func (r Registry) Resolve(ctx context.Context, name, version string) (string, error) {
+	versions, tags, err := r.Versions(ctx, name, version)
+	if err != nil {
+		return "", err
+	}
+
+	return ResolveVersion(name, version, versions, tags)
+}
+
+// Versions retrieves the versions and dist-tags of the package, the requested version is only used in errors
+func (r Registry) Versions(ctx context.Context, name, version string) ([]string, map[string]string, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.BaseURL+name, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the abbreviated metadata only holds what is needed to resolve versions
+	req.Header.Set("Accept", "application/vnd.npm.install-v1+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = ResponseError(resp, r.Provider, name, version, ErrPackageNotFound); err != nil {
+		return nil, nil, err
+	}
+
+	var pkg struct {
+		DistTags map[string]string          `json:"dist-tags"`
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&pkg); err != nil {
+		return nil, nil, err
+	}
+
+	versions := make([]string, 0, len(pkg.Versions))
+	for v := range pkg.Versions {
+		versions = append(versions, v)
+	}
+
+	return versions, pkg.DistTags, nil
+}
@@ -0,0 +1,151 @@
+package library
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry is an http.RoundTripper retrying requests that failed with a network error, a 429 or a 5xx
+// response. Attempts are spaced with exponential backoff and jitter, a Retry-After header of the response
+// is honored up to MaxDelay, a longer one ends the retries. Only GET and HEAD requests are retried. The zero value retries with the defaults below.
+type Retry struct {
+	MaxAttempts int               // attempts including the first one, 0 uses 4
+	BaseDelay   time.Duration     // delay before the first retry, doubled for every next one, 0 uses 500ms
+	MaxDelay    time.Duration     // upper bound of a single backoff delay and of Retry-After, 0 uses 30s
+	MaxElapsed  time.Duration     // time budget of all attempts together, 0 means no budget
+	Transport   http.RoundTripper // transport making the requests, nil uses http.DefaultTransport
+}
+
+const (
+	defaultRetryAttempts  = 4
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// Client returns a copy of c whose transport retries, wrapping the transport of c. A nil c copies
+// http.DefaultClient.
+func (r Retry) Client(c *http.Client) *http.Client {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	retrying := *c
+	if r.Transport == nil {
+		r.Transport = c.Transport
+	}
+	retrying.Transport = &r
+
+	return &retrying
+}
+
+func (r *Retry) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return transport.RoundTrip(req)
+	}
+
+	attempts := r.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+
+	var deadline time.Time
+	if r.MaxElapsed > 0 {
+		deadline = time.Now().Add(r.MaxElapsed)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := transport.RoundTrip(req)
+		if attempt >= attempts || !retryable(req.Context(), resp, err) {
+			return resp, err
+		}
+
+		delay := r.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				// a server asking for a longer pause than a single backoff may take is not waited for
+				if after > r.maxDelay() {
+					return resp, err
+				}
+				delay = after
+			}
+		}
+
+		// give up with the last result when the next attempt would not start within the budget
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the given retry, a random duration between half and all of the
+// exponential delay so concurrent clients do not retry in lockstep
+func (r *Retry) backoff(attempt int) time.Duration {
+	base, maxDelay := r.BaseDelay, r.maxDelay()
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+
+	delay := maxDelay
+	if shift := attempt - 1; shift < 32 && base<<shift > 0 && base<<shift < maxDelay {
+		delay = base << shift
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// maxDelay returns the upper bound of a single delay
+func (r *Retry) maxDelay() time.Duration {
+	if r.MaxDelay <= 0 {
+		return defaultRetryMaxDelay
+	}
+
+	return r.MaxDelay
+}
+
+// retryable reports whether a request with this outcome is worth another attempt
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented
+}
+
+// retryAfter parses a Retry-After header holding either a number of seconds or an http date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(header); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+
+	return 0, false
+}
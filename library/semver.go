@@ -0,0 +1,455 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Version is a parsed semantic version, build metadata is dropped
+	Version struct {
+		Major      int
+		Minor      int
+		Patch      int
+		Prerelease string
+	}
+
+	// Range is a parsed npm version range like ^1.9, ~2.0.3 or >=5 <6 || 7.x
+	Range struct {
+		sets [][]comparator
+	}
+
+	comparator struct {
+		op      string // one of =, <, <=, >, >=
+		version Version
+	}
+
+	// partial is a version of a range in which missing or wildcard parts are -1
+	partial struct {
+		major, minor, patch int
+		prerelease          string
+	}
+)
+
+// ParseVersion parses a semantic version, a leading v or = is allowed
+func ParseVersion(s string) (Version, error) {
+	p, err := parsePartial(s)
+	if err != nil {
+		return Version{}, err
+	}
+
+	if p.patch < 0 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	return Version{Major: p.major, Minor: p.minor, Patch: p.patch, Prerelease: p.prerelease}, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 when v is lower than, equal to or higher than o
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+
+	a, b := strings.Split(v.Prerelease, "."), strings.Split(o.Prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareIdentifier(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	return sign(len(a) - len(b))
+}
+
+// compareIdentifier compares prerelease identifiers, numeric identifiers are lower than alphanumeric ones
+func compareIdentifier(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(an - bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+func sign(d int) int {
+	switch {
+	case d < 0:
+		return -1
+	case d > 0:
+		return 1
+	}
+	return 0
+}
+
+func parsePartial(s string) (partial, error) {
+	p := partial{major: -1, minor: -1, patch: -1}
+
+	v := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "="), "v")
+	v, _, _ = strings.Cut(v, "+")
+	v, p.prerelease, _ = strings.Cut(v, "-")
+
+	if v == "" {
+		return p, fmt.Errorf("invalid version %q", s)
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return p, fmt.Errorf("invalid version %q", s)
+	}
+
+	nums := []*int{&p.major, &p.minor, &p.patch}
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i] = n
+	}
+
+	if p.prerelease != "" && p.patch < 0 {
+		return p, fmt.Errorf("invalid version %q", s)
+	}
+
+	return p, nil
+}
+
+// lower returns the lowest version of the partial
+func (p partial) lower() Version {
+	return Version{Major: max(p.major, 0), Minor: max(p.minor, 0), Patch: max(p.patch, 0), Prerelease: p.prerelease}
+}
+
+// next returns the first version above the partial, e.g. 1.3.0 for 1.2 and 2.0.0 for 1
+func (p partial) next() Version {
+	switch {
+	case p.minor < 0:
+		return Version{Major: p.major + 1}
+	case p.patch < 0:
+		return Version{Major: p.major, Minor: p.minor + 1}
+	}
+	return Version{Major: p.major, Minor: p.minor, Patch: p.patch + 1}
+}
+
+// ParseRange parses an npm version range
+func ParseRange(s string) (Range, error) {
+	var r Range
+
+	for _, set := range strings.Split(s, "||") {
+		comparators, err := parseSet(strings.TrimSpace(set))
+		if err != nil {
+			return r, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+		r.sets = append(r.sets, comparators)
+	}
+
+	return r, nil
+}
+
+func parseSet(s string) ([]comparator, error) {
+	fields := strings.Fields(s)
+
+	// hyphen range, 1.2.3 - 2.3.4
+	if len(fields) == 3 && fields[1] == "-" {
+		from, err := parsePartial(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePartial(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		comparators := []comparator{{op: ">=", version: from.lower()}}
+		if to.major < 0 {
+			return comparators, nil
+		}
+		if to.patch < 0 {
+			return append(comparators, comparator{op: "<", version: to.next()}), nil
+		}
+		return append(comparators, comparator{op: "<=", version: to.lower()}), nil
+	}
+
+	var comparators []comparator
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+
+		// an operator separated from its version, >= 1.2.3
+		if strings.Trim(field, "<>=~^") == "" && i+1 < len(fields) {
+			i++
+			field += fields[i]
+		}
+
+		c, err := parseComparator(field)
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, c...)
+	}
+
+	return comparators, nil
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, o := range []string{">=", "<=", ">", "<", "=", "~>", "~", "^"} {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+
+	v := strings.TrimPrefix(s, op)
+	if v == "" || v == "*" || v == "x" || v == "X" {
+		if op == "<" || op == ">" {
+			// nothing is below or above everything
+			return []comparator{{op: "<", version: Version{}}}, nil
+		}
+		return nil, nil
+	}
+
+	p, err := parsePartial(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.major < 0 {
+		return nil, nil
+	}
+
+	switch op {
+	case "", "=":
+		if p.patch >= 0 {
+			return []comparator{{op: "=", version: p.lower()}}, nil
+		}
+		return []comparator{{op: ">=", version: p.lower()}, {op: "<", version: p.next()}}, nil
+	case ">":
+		if p.patch >= 0 {
+			return []comparator{{op: ">", version: p.lower()}}, nil
+		}
+		return []comparator{{op: ">=", version: p.next()}}, nil
+	case ">=":
+		return []comparator{{op: ">=", version: p.lower()}}, nil
+	case "<":
+		return []comparator{{op: "<", version: p.lower()}}, nil
+	case "<=":
+		if p.patch >= 0 {
+			return []comparator{{op: "<=", version: p.lower()}}, nil
+		}
+		return []comparator{{op: "<", version: p.next()}}, nil
+	case "~", "~>":
+		upper := partial{major: p.major, minor: p.minor, patch: -1}
+		return []comparator{{op: ">=", version: p.lower()}, {op: "<", version: upper.next()}}, nil
+	case "^":
+		var upper Version
+		switch {
+		case p.major > 0 || p.minor < 0:
+			upper = Version{Major: p.major + 1}
+		case p.minor > 0 || p.patch < 0:
+			upper = Version{Minor: p.minor + 1}
+		default:
+			upper = Version{Patch: p.patch + 1}
+		}
+		return []comparator{{op: ">=", version: p.lower()}, {op: "<", version: upper}}, nil
+	}
+
+	return nil, fmt.Errorf("invalid comparator %q", s)
+}
+
+// Match reports whether the version satisfies the range. Like npm, prereleases only match when a
+// comparator of the same set has a prerelease on the same major, minor and patch.
+func (r Range) Match(v Version) bool {
+	for _, set := range r.sets {
+		if matchSet(set, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchSet(set []comparator, v Version) bool {
+	for _, c := range set {
+		if !c.match(v) {
+			return false
+		}
+	}
+
+	if v.Prerelease == "" {
+		return true
+	}
+
+	for _, c := range set {
+		if c.version.Prerelease != "" && c.version.Major == v.Major && c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c comparator) match(v Version) bool {
+	d := v.Compare(c.version)
+
+	switch c.op {
+	case "=":
+		return d == 0
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	}
+
+	return false
+}
+
+// ErrVersionNotFound is matched by every *VersionNotFoundError
+var ErrVersionNotFound = errors.New("version not found")
+
+// VersionNotFoundError is returned when no version of a package matches the requested version, tag or range
+type VersionNotFoundError struct {
+	Package string
+	Version string
+	Nearby  []string // available versions close to the requested one, lowest first
+}
+
+func (e *VersionNotFoundError) Error() string {
+	msg := fmt.Sprintf("no version of %s matches %q", e.Package, e.Version)
+	if len(e.Nearby) > 0 {
+		msg += ", nearby versions: " + strings.Join(e.Nearby, ", ")
+	}
+	return msg
+}
+
+func (e *VersionNotFoundError) Is(target error) bool {
+	return target == ErrVersionNotFound
+}
+
+// ResolveVersion returns the version of the package matching the spec: an exact version, a dist-tag like
+// next or an npm range. Ranges resolve to the highest matching version, an empty spec resolves to the
+// latest tag. When nothing matches a *VersionNotFoundError is returned.
+func ResolveVersion(name string, spec string, versions []string, tags map[string]string) (string, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		spec = "latest"
+	}
+
+	if v, ok := tags[spec]; ok && v != "" {
+		return v, nil
+	}
+
+	for _, v := range versions {
+		if v == spec {
+			return v, nil
+		}
+	}
+
+	rangeSpec := spec
+	if spec == "latest" {
+		rangeSpec = "*"
+	}
+
+	var (
+		best  string
+		bestV Version
+	)
+
+	if r, err := ParseRange(rangeSpec); err == nil {
+		for _, s := range versions {
+			v, err := ParseVersion(s)
+			if err != nil || !r.Match(v) {
+				continue
+			}
+
+			if best == "" || v.Compare(bestV) > 0 {
+				best, bestV = s, v
+			}
+		}
+	}
+
+	if best == "" {
+		return "", &VersionNotFoundError{Package: name, Version: spec, Nearby: nearbyVersions(spec, versions)}
+	}
+
+	return best, nil
+}
+
+// nearbyVersionCount is the number of versions listed in a VersionNotFoundError
+const nearbyVersionCount = 6
+
+var partialPattern = regexp.MustCompile(`\d+(\.\d+){0,2}`)
+
+// nearbyVersions returns the released versions around the first version mentioned in the spec, or the
+// most recent ones when the spec does not mention a version
+func nearbyVersions(spec string, versions []string) []string {
+	type parsed struct {
+		raw string
+		v   Version
+	}
+
+	var released []parsed
+	for _, s := range versions {
+		v, err := ParseVersion(s)
+		if err == nil && v.Prerelease == "" {
+			released = append(released, parsed{raw: s, v: v})
+		}
+	}
+
+	sort.Slice(released, func(i, j int) bool {
+		return released[i].v.Compare(released[j].v) < 0
+	})
+
+	at := len(released)
+	if p, err := parsePartial(partialPattern.FindString(spec)); err == nil {
+		target := p.lower()
+		at = sort.Search(len(released), func(i int) bool {
+			return released[i].v.Compare(target) >= 0
+		})
+	}
+
+	from := max(0, min(at-nearbyVersionCount/2, len(released)-nearbyVersionCount))
+	to := min(len(released), from+nearbyVersionCount)
+
+	nearby := make([]string, 0, to-from)
+	for _, p := range released[from:to] {
+		nearby = append(nearby, p.raw)
+	}
+
+	return nearby
+}
@@ -0,0 +1,116 @@
+package library
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRangeMatch(t *testing.T) {
+	var tests = []struct {
+		rng     string
+		version string
+		want    bool
+	}{
+		{"^1.9", "1.9.0", true},
+		{"^1.9", "1.12.4", true},
+		{"^1.9", "2.0.0", false},
+		{"^1.9", "1.8.9", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"~2.0.3", "2.0.9", true},
+		{"~2.0.3", "2.1.0", false},
+		{"~2", "2.9.9", true},
+		{">=5 <6", "5.3.3", true},
+		{">=5 <6", "6.0.0", false},
+		{">= 5 < 6", "5.0.0", true},
+		{"1.2.x", "1.2.7", true},
+		{"1.2.x", "1.3.0", false},
+		{"1.2.3 - 2.3", "2.3.9", true},
+		{"1.2.3 - 2.3", "2.4.0", false},
+		{"<=1.2", "1.2.9", true},
+		{">1.2", "1.2.9", false},
+		{"^1 || ^3", "3.1.0", true},
+		{"^1 || ^3", "2.1.0", false},
+		{"*", "4.0.0", true},
+		{"*", "4.0.0-beta.1", false},
+		{">=4.0.0-beta.1", "4.0.0-beta.2", true},
+		{">=4.0.0-beta.1", "4.0.1-beta.1", false},
+		{"2.0.4", "2.0.4", true},
+		{"2.0.4", "2.0.5", false},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRange(tt.rng)
+		if err != nil {
+			t.Errorf("%s: %v", tt.rng, err)
+			continue
+		}
+
+		v, err := ParseVersion(tt.version)
+		if err != nil {
+			t.Errorf("%s: %v", tt.version, err)
+			continue
+		}
+
+		if got := r.Match(v); got != tt.want {
+			t.Errorf("%s matches %s = %v, want %v", tt.rng, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	versions := []string{"1.9.12", "2.0.0-beta.1", "1.10.0", "2.0.4", "2.0.3", "1.9.2"}
+	tags := map[string]string{"latest": "2.0.4", "next": "2.0.0-beta.1"}
+
+	var tests = []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"", "2.0.4", false},
+		{"next", "2.0.0-beta.1", false},
+		{"^1.9", "1.10.0", false},
+		{"~1.9.2", "1.9.12", false},
+		{"2.0.3", "2.0.3", false},
+		{">=2.1", "", true},
+		{"3.0.0", "", true},
+		{"not a version", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ResolveVersion("htmx", tt.spec, versions, tags)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ResolveVersion(%q) = %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestVersionNotFound(t *testing.T) {
+	versions := []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0", "2.0.0", "2.1.0", "2.2.0", "3.0.0-beta.1", "3.1.0", "3.2.0"}
+
+	var tests = []struct {
+		spec   string
+		nearby string
+	}{
+		{"2.0.9", "1.2.0,1.3.0,2.0.0,2.1.0,2.2.0,3.1.0"},
+		{"^9", "1.3.0,2.0.0,2.1.0,2.2.0,3.1.0,3.2.0"},
+		{"canary", "1.3.0,2.0.0,2.1.0,2.2.0,3.1.0,3.2.0"},
+		{"<1", "1.0.0,1.1.0,1.2.0,1.3.0,2.0.0,2.1.0"},
+	}
+
+	for _, tt := range tests {
+		_, err := ResolveVersion("lib", tt.spec, versions, nil)
+
+		var notFound *VersionNotFoundError
+		if !errors.As(err, &notFound) || !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("%s: expected a VersionNotFoundError, got %v", tt.spec, err)
+			continue
+		}
+
+		if got := strings.Join(notFound.Nearby, ","); got != tt.nearby {
+			t.Errorf("%s: got nearby %s, want %s", tt.spec, got, tt.nearby)
+		}
+	}
+}
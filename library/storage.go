@@ -0,0 +1,126 @@
+package library
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrReadOnly is returned when writing to a read only storage
+var ErrReadOnly = errors.New("storage is read only")
+
+type (
+	// Storage is a writable file system holding the cache and assets. Names are slash separated paths
+	// like in io/fs.
+	Storage interface {
+		fs.FS
+		// WriteFile creates or replaces the named file with the content of r, missing directories are created
+		WriteFile(name string, r io.Reader) error
+		// RemoveAll removes the named file or directory and everything it contains
+		RemoveAll(name string) error
+	}
+
+	// DirStorage is a Storage backed by a directory on disk
+	DirStorage string
+
+	readOnly struct {
+		fs.FS
+	}
+)
+
+// ReadOnly returns a Storage that reads from fsys and refuses writes, e.g. for assets compiled in with //go:embed
+func ReadOnly(fsys fs.FS) Storage {
+	return readOnly{FS: fsys}
+}
+
+func (readOnly) WriteFile(string, io.Reader) error {
+	return ErrReadOnly
+}
+
+func (readOnly) RemoveAll(string) error {
+	return ErrReadOnly
+}
+
+// path returns the path on disk of the named file, leading slashes are ignored
+func (d DirStorage) path(op string, name string) (string, error) {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+func (d DirStorage) Open(name string) (fs.File, error) {
+	p, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+// WriteFile writes to a temporary file next to the named file and renames it once complete, so a failed
+// or partial write never replaces the file
+func (d DirStorage) WriteFile(name string, r io.Reader) error {
+	p, err := d.path("write", name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		return err
+	}
+
+	err = file.Chmod(os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), p)
+}
+
+func (d DirStorage) RemoveAll(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(p)
+}
+
+// exists reports whether the named file or directory exists
+func exists(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, strings.TrimPrefix(name, "/"))
+	return err == nil
+}
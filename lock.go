@@ -0,0 +1,170 @@
+package importmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+var (
+	defaultLockFile      = "importmap.lock.json"
+	defaultLockAlgorithm = library.SHA384
+)
+
+type (
+	// Lock holds the resolved state of every fetched package
+	Lock struct {
+		Packages []LockedPackage `json:"packages"`
+	}
+
+	// LockedPackage is the resolved version, provider and files of a package
+	LockedPackage struct {
+		Name         string       `json:"name"`
+		Scope        string       `json:"scope,omitempty"`
+		Version      string       `json:"version"`
+		Requested    string       `json:"requested,omitempty"` // the version, range or dist-tag the package asked for
+		Provider     string       `json:"provider,omitempty"`
+		Entry        string       `json:"entry,omitempty"`        // set for transitive dependencies, the file their name resolves to
+		Dependencies []string     `json:"dependencies,omitempty"` // names of the resolved dependencies of the package
+		Files        []LockedFile `json:"files"`
+	}
+
+	// LockedFile is a single file of a locked package
+	LockedFile struct {
+		Path      string `json:"path"`
+		URL       string `json:"url"`
+		Integrity string `json:"integrity,omitempty"`
+	}
+)
+
+// ReadLock reads the lockfile from disk, a missing file results in an empty lock
+func ReadLock(name string) (*Lock, error) {
+	return ReadLockFS(library.DirStorage(filepath.Dir(name)), filepath.Base(name))
+}
+
+// ReadLockFS reads the lockfile from fsys, a missing file results in an empty lock
+func ReadLockFS(fsys fs.FS, name string) (*Lock, error) {
+	b, err := fs.ReadFile(fsys, strings.TrimPrefix(name, "/"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Lock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var l Lock
+	if err = json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// Write stores the lockfile on disk
+func (l *Lock) Write(name string) error {
+	return l.Store(library.DirStorage(filepath.Dir(name)), filepath.Base(name))
+}
+
+// Store writes the lockfile to the storage
+func (l *Lock) Store(st library.Storage, name string) error {
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return st.WriteFile(name, bytes.NewReader(append(b, '\n')))
+}
+
+// Get returns the locked package with the given name and scope, or nil when it is not locked
+func (l *Lock) Get(name, scope string) *LockedPackage {
+	if l == nil {
+		return nil
+	}
+
+	for i := range l.Packages {
+		if l.Packages[i].Name == name && l.Packages[i].Scope == scope {
+			return &l.Packages[i]
+		}
+	}
+
+	return nil
+}
+
+// Set adds or replaces the locked package, packages are kept sorted by name and scope
+func (l *Lock) Set(p LockedPackage) {
+	if lp := l.Get(p.Name, p.Scope); lp != nil {
+		*lp = p
+		return
+	}
+
+	l.Packages = append(l.Packages, p)
+	sort.SliceStable(l.Packages, func(i, j int) bool {
+		if l.Packages[i].Name != l.Packages[j].Name {
+			return l.Packages[i].Name < l.Packages[j].Name
+		}
+		return l.Packages[i].Scope < l.Packages[j].Scope
+	})
+}
+
+// Remove deletes the locked package with the given name and scope
+func (l *Lock) Remove(name, scope string) {
+	for i := range l.Packages {
+		if l.Packages[i].Name == name && l.Packages[i].Scope == scope {
+			l.Packages = append(l.Packages[:i], l.Packages[i+1:]...)
+			return
+		}
+	}
+}
+
+// Retain keeps only the packages for which keep returns true
+func (l *Lock) Retain(keep func(LockedPackage) bool) {
+	if l == nil {
+		return
+	}
+
+	packages := l.Packages[:0]
+	for _, p := range l.Packages {
+		if keep(p) {
+			packages = append(packages, p)
+		}
+	}
+
+	l.Packages = packages
+}
+
+// Satisfies reports whether the locked package fulfils the requested version. A dist-tag like next is
+// satisfied by the version it was locked with, until Fetch resolves the tag again.
+func (lp *LockedPackage) Satisfies(requested string) bool {
+	return satisfies(requested, lp.Version) || (lp.Requested != "" && lp.Requested == requested)
+}
+
+// LibraryFiles returns the locked files as library files
+func (lp *LockedPackage) LibraryFiles() library.Files {
+	files := make(library.Files, 0, len(lp.Files))
+	for _, f := range lp.Files {
+		files = append(files, library.File{
+			Type:      library.ExtractFileType(f.Path),
+			Path:      f.URL,
+			LocalPath: f.Path,
+		})
+	}
+
+	return files
+}
+
+// File returns the locked file with the given local path, or nil when it is not locked
+func (lp *LockedPackage) File(localPath string) *LockedFile {
+	for i := range lp.Files {
+		if lp.Files[i].Path == localPath {
+			return &lp.Files[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package importmap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+type (
+	// MissingError is returned in offline mode when packages or files are not available locally
+	MissingError struct {
+		Packages []MissingPackage
+	}
+
+	// MissingPackage describes what is missing of a single package, Files is empty when the package
+	// is not in the lockfile at all
+	MissingPackage struct {
+		Name    string
+		Version string
+		Scope   string
+		Files   []string
+	}
+)
+
+func (e *MissingError) Error() string {
+	var parts []string
+	for _, p := range e.Packages {
+		name := p.Name
+		if p.Version != "" {
+			name += "@" + p.Version
+		}
+		if p.Scope != "" {
+			name += " (scope " + p.Scope + ")"
+		}
+
+		if len(p.Files) == 0 {
+			parts = append(parts, name+" is not locked")
+			continue
+		}
+
+		parts = append(parts, fmt.Sprintf("%s is missing %s", name, strings.Join(p.Files, ", ")))
+	}
+
+	return "offline: " + strings.Join(parts, "; ")
+}
+
+// missingFiles returns the required files that are neither in the cache nor in the assets
+func (im *ImportMap) missingFiles(pkg library.Package, files library.Files) []string {
+	var missing []string
+	for _, file := range files {
+		if im.assetsDir != nil && im.fingerprint {
+			if _, ok := pkg.FingerprintedAsset(im.store(), *im.assetsDir, file.LocalPath); ok {
+				continue
+			}
+		} else if im.assetsDir != nil && pkg.HasAssetFile(im.store(), *im.assetsDir, file.LocalPath) {
+			continue
+		}
+
+		if im.cacheDir != nil && pkg.HasCacheFile(im.store(), *im.cacheDir, file.LocalPath) {
+			continue
+		}
+
+		missing = append(missing, file.LocalPath)
+	}
+
+	return missing
+}
+
+// lockedDependencies returns the packages recorded in the lockfile as dependencies of other packages and
+// records which packages require them, see WithEntrypoint
+func (im *ImportMap) lockedDependencies(lock *Lock) []library.Package {
+	if lock == nil {
+		return nil
+	}
+
+	var packages []library.Package
+	for _, lp := range lock.Packages {
+		for _, dep := range lp.Dependencies {
+			im.require(lp.Name, dep)
+		}
+
+		if lp.Entry == "" || (lp.Scope == "" && im.hasPackage(lp.Name)) {
+			continue
+		}
+
+		packages = append(packages, library.Package{
+			Name:    lp.Name,
+			Version: lp.Version,
+			Scope:   lp.Scope,
+			Require: library.Includes{{File: lp.Entry, As: lp.Name}},
+		})
+	}
+
+	return packages
+}
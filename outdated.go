@@ -0,0 +1,132 @@
+package importmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+// OutdatedPackage compares the version a package is pinned to with the versions its provider lists.
+// Patch, Minor and Major are never lower than Current, prereleases are only reported as Current.
+type OutdatedPackage struct {
+	Name      string
+	Scope     string
+	Provider  string
+	Requested string // the version of the package, an exact version, a range or a tag
+	Current   string // the locked version, or without a lock entry the version Requested resolves to
+	Patch     string // highest version with the major and minor version of Current
+	Minor     string // highest version with the major version of Current
+	Major     string // highest version
+}
+
+// Outdated reports whether a newer version than Current exists
+func (o OutdatedPackage) Outdated() bool {
+	return o.Major != o.Current
+}
+
+// Outdated asks the provider of every package for its versions and reports the current version next to the
+// latest patch, minor and major version, in the order of the packages. Packages whose provider can not
+// list versions, like raw, are left out. A failing package does not stop the others, all errors are
+// returned joined together.
+func (im *ImportMap) Outdated(ctx context.Context) ([]OutdatedPackage, error) {
+	lock, err := im.readLock()
+	if err != nil {
+		return nil, err
+	}
+
+	im.configureProviders()
+
+	concurrency := im.concurrency
+	if concurrency < 1 {
+		concurrency = defaultConcurrency
+	}
+
+	results := make([]*OutdatedPackage, len(im.packages))
+	errs := make(limiter, concurrency).forEach(len(im.packages), func(i int) error {
+		var err error
+		results[i], err = im.outdated(ctx, lock, im.packages[i])
+		if err != nil {
+			return fmt.Errorf("package %s: %w", im.packages[i].Name, err)
+		}
+		return nil
+	})
+
+	var out []OutdatedPackage
+	for _, res := range results {
+		if res != nil {
+			out = append(out, *res)
+		}
+	}
+
+	return out, errors.Join(errs...)
+}
+
+// outdated compares a single package, nil is returned when its provider can not list versions
+func (im *ImportMap) outdated(ctx context.Context, lock *Lock, pkg library.Package) (*OutdatedPackage, error) {
+	provider := pkg.Provider
+	if provider == nil {
+		provider = im.provider
+	}
+
+	lister, ok := provider.(library.VersionLister)
+	if !ok {
+		return nil, nil
+	}
+
+	versions, err := lister.FetchVersions(ctx, pkg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &OutdatedPackage{
+		Name:      pkg.Name,
+		Scope:     pkg.Scope,
+		Provider:  library.ProviderName(provider),
+		Requested: pkg.Version,
+	}
+
+	// the locked version is what is served, it also stands in for a dist-tag the versions do not resolve
+	if locked := lock.Get(pkg.Name, pkg.Scope); locked != nil && locked.Provider == res.Provider {
+		res.Current = locked.Version
+	} else {
+		res.Current, err = library.ResolveVersion(pkg.Name, pkg.Version, versions, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := library.ParseVersion(res.Current)
+	if err != nil {
+		return nil, err
+	}
+
+	// the highest patch, minor and major version, as listed by the provider
+	type candidate struct {
+		raw     string
+		version library.Version
+	}
+	latest := [3]candidate{{res.Current, current}, {res.Current, current}, {res.Current, current}}
+
+	for _, s := range versions {
+		v, err := library.ParseVersion(s)
+		if err != nil || v.Prerelease != "" {
+			continue
+		}
+
+		if v.Major == current.Major && v.Minor == current.Minor && v.Compare(latest[0].version) > 0 {
+			latest[0] = candidate{s, v}
+		}
+		if v.Major == current.Major && v.Compare(latest[1].version) > 0 {
+			latest[1] = candidate{s, v}
+		}
+		if v.Compare(latest[2].version) > 0 {
+			latest[2] = candidate{s, v}
+		}
+	}
+
+	res.Patch, res.Minor, res.Major = latest[0].raw, latest[1].raw, latest[2].raw
+
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package importmap
+
+import (
+	"sync"
+)
+
+var defaultConcurrency = 4
+
+type (
+	// fetchRun holds the state shared by all packages of a single Fetch
+	fetchRun struct {
+		lock     *Lock
+		touched  map[string]bool // lock entries written during the run, keyed by scope and name
+		missing  MissingError    // packages and files missing in offline mode
+		packages limiter         // bounds the packages being resolved
+		files    limiter         // bounds the files being downloaded, shared by all packages
+	}
+
+	// limiter bounds the number of functions running at the same time
+	limiter chan struct{}
+)
+
+func newFetchRun(lock *Lock, concurrency int) *fetchRun {
+	if concurrency < 1 {
+		concurrency = defaultConcurrency
+	}
+
+	return &fetchRun{
+		lock:     lock,
+		touched:  make(map[string]bool),
+		packages: make(limiter, concurrency),
+		files:    make(limiter, concurrency),
+	}
+}
+
+// forEach calls fn for every index in [0, n) and waits for all calls to finish. The returned errors
+// are indexed like the calls.
+func (l limiter) forEach(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		l <- struct{}{}
+
+		go func() {
+			defer func() {
+				<-l
+				wg.Done()
+			}()
+
+			errs[i] = fn(i)
+		}()
+	}
+
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,167 @@
+package importmap
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/donseba/go-importmap/library"
+)
+
+// staticImportPattern matches the specifiers of static import and export-from statements, dynamic imports
+// are loaded on demand and therefore not preloaded
+var staticImportPattern = regexp.MustCompile(`(?:^|[\s;})])(?:import\s*(?:[\w$*{},\s]+?\s*from\s*)?|export\s*(?:\*(?:\s*as\s+[\w$]+)?|\{[^}]*\})\s*from\s*)["']([^"'\s]+)["']`)
+
+// dynamicImportPattern matches the specifiers of dynamic imports with a string literal
+var dynamicImportPattern = regexp.MustCompile(`(?:^|[^\w$.])import\s*\(\s*["']([^"'\s]+)["']\s*\)`)
+
+// moduleImports are the specifiers a local module imports
+type moduleImports struct {
+	static  []string
+	dynamic []string
+}
+
+// preloads returns the urls of the specifiers and of all modules they statically import, in the order they
+// are found. The imports of local modules are read from the storage, remote modules are preloaded
+// without following their imports.
+func (im *ImportMap) preloads(s structure, specifiers []string) ([]string, error) {
+	var (
+		urls  []string
+		queue []string
+		seen  = make(map[string]bool)
+	)
+
+	add := func(u string) {
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+			queue = append(queue, u)
+		}
+	}
+
+	for _, specifier := range specifiers {
+		u, ok := s.resolve(specifier, "")
+		if !ok {
+			return nil, fmt.Errorf("preload: unknown specifier %q", specifier)
+		}
+		add(u)
+	}
+
+	for len(queue) > 0 {
+		referrer := queue[0]
+		queue = queue[1:]
+
+		for _, specifier := range im.moduleImports(referrer).static {
+			if u, ok := s.resolve(specifier, referrer); ok {
+				add(u)
+			}
+		}
+	}
+
+	return urls, nil
+}
+
+// moduleImports returns the specifiers a local module imports, the result is kept until the next fetch
+func (im *ImportMap) moduleImports(moduleURL string) moduleImports {
+	if !strings.HasPrefix(moduleURL, "/") || strings.HasPrefix(moduleURL, "//") {
+		return moduleImports{}
+	}
+
+	if cached, ok := im.graph.Load(moduleURL); ok {
+		return cached.(moduleImports)
+	}
+
+	var imports moduleImports
+	if name := strings.TrimPrefix(moduleURL, "/"); library.ExtractFileType(name) == library.FileTypeJS {
+		if b, err := fs.ReadFile(im.store(), name); err == nil {
+			for _, m := range staticImportPattern.FindAllSubmatch(b, -1) {
+				imports.static = append(imports.static, string(m[1]))
+			}
+			for _, m := range dynamicImportPattern.FindAllSubmatch(b, -1) {
+				imports.dynamic = append(imports.dynamic, string(m[1]))
+			}
+		}
+	}
+
+	im.graph.Store(moduleURL, imports)
+
+	return imports
+}
+
+// resolve resolves the specifier like the browser does with the import map: relative and absolute urls
+// against the referrer, bare specifiers through the scopes matching the referrer and then the top level
+// imports
+func (s structure) resolve(specifier, referrer string) (string, bool) {
+	if !bare(specifier) {
+		base, err := url.Parse(referrer)
+		if err != nil {
+			return "", false
+		}
+		ref, err := url.Parse(specifier)
+		if err != nil {
+			return "", false
+		}
+		return base.ResolveReference(ref).String(), true
+	}
+
+	scope, key, ok := s.lookup(specifier, referrer)
+	if !ok {
+		return "", false
+	}
+
+	imports := s.Imports
+	if scope != "" {
+		imports = s.Scopes[scope]
+	}
+
+	return imports[key] + strings.TrimPrefix(specifier, key), true
+}
+
+// lookup returns the scope and the key mapping the bare specifier for the referrer, the scope is empty when
+// the specifier is mapped by the top level imports
+func (s structure) lookup(specifier, referrer string) (scope, key string, ok bool) {
+	// the longest scope prefix matching the referrer wins
+	var scopes []string
+	for prefix := range s.Scopes {
+		if referrer != "" && strings.HasPrefix(referrer, prefix) {
+			scopes = append(scopes, prefix)
+		}
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		return len(scopes[i]) > len(scopes[j])
+	})
+
+	for _, prefix := range scopes {
+		if key, ok := specifierKey(s.Scopes[prefix], specifier); ok {
+			return prefix, key, true
+		}
+	}
+
+	key, ok = specifierKey(s.Imports, specifier)
+	return "", key, ok
+}
+
+// specifierKey returns the key of the imports mapping the specifier, keys ending in a slash map every
+// specifier starting with them
+func specifierKey(imports map[string]string, specifier string) (string, bool) {
+	if _, ok := imports[specifier]; ok {
+		return specifier, true
+	}
+
+	best := ""
+	for key := range imports {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(specifier, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+
+	return best, best != ""
+}
+
+// bare reports whether the specifier is resolved through the import map rather than as a url
+func bare(specifier string) bool {
+	return !strings.HasPrefix(specifier, "./") && !strings.HasPrefix(specifier, "../") && !strings.HasPrefix(specifier, "/") && !strings.Contains(specifier, "://")
+}